@@ -36,11 +36,32 @@ func bs2u(b []byte, sizeBits int) (v uint64, length int) {
 // u2bs (uint64 to bytes with size) returns the minimum byte representation of
 // v with byte size info in big endian
 func u2bs(v uint64, sizeBits int) []byte {
+	return appendU2bs(nil, v, sizeBits)
+}
+
+// appendU2bs appends the byte representation of v returned by u2bs to dst without intermediate allocations
+func appendU2bs(dst []byte, v uint64, sizeBits int) []byte {
 	valueByteCount, totalByteCount := byteCount(v, sizeBits)
 	if totalByteCount > valueByteCount {
-		return append([]byte{byte(totalByteCount << (8 - sizeBits))}, u2b(v, valueByteCount)...)
+		dst = append(dst, byte(totalByteCount<<(8-sizeBits)))
+		return appendU2b(dst, v, valueByteCount)
 	}
-	return u2b(v|uint64(totalByteCount<<(8*totalByteCount-sizeBits)), totalByteCount)
+	return appendU2b(dst, v|uint64(totalByteCount<<(8*totalByteCount-sizeBits)), totalByteCount)
+}
+
+// putU2bs writes v to b in the format of u2bs padded to len(b) bytes (at most 8)
+// and reports whether v fits b
+func putU2bs(b []byte, v uint64, sizeBits int) bool {
+	size := len(b)
+	if bits.Len64(v) > 8*size-sizeBits {
+		return false
+	}
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= byte(size << (8 - sizeBits))
+	return true
 }
 
 func byteCount(v uint64, metaBitCount int) (valueByteCount int, totalByteCount int) {
@@ -72,6 +93,15 @@ func u2b(v uint64, size int) []byte {
 	return bytes
 }
 
+// appendU2b appends the v's byte representation of the given size in big endian to dst
+func appendU2b(dst []byte, v uint64, size int) []byte {
+	for size > 0 {
+		size--
+		dst = append(dst, byte(v>>(size<<3)))
+	}
+	return dst
+}
+
 func b2u(bytes []byte) uint64 {
 	var v uint64
 	for i, size := 0, len(bytes); i < size; i++ {
@@ -2,11 +2,18 @@ package codec
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/big"
+	"net/url"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 	"unsafe"
 
 	"github.com/URALINNOVATSIYA/reflex"
@@ -20,13 +27,13 @@ type testItem struct {
 	eq    eq
 }
 
-func runTests(items []testItem, typeRegistry *TypeRegistry, t *testing.T) {
-	serializer := NewSerializer().WithTypeRegistry(typeRegistry)
-	unserializer := NewUnserializer().WithTypeRegistry(typeRegistry)
+func runTests(items []testItem, typeRegistry *TypeRegistry, t *testing.T, options ...any) {
+	serializer := NewSerializer().WithTypeRegistry(typeRegistry).WithOptions(options)
+	unserializer := NewUnserializer().WithTypeRegistry(typeRegistry).WithOptions(options)
 	for i, item := range items {
 		expected := item.value
 		data := serializer.Encode(expected)
-		if !bytes.Equal(data, item.data) {
+		if item.data != nil && !bytes.Equal(data, item.data) { // nil data means non-deterministic encoding, e.g. of maps
 			t.Errorf("Test #%d: Encode(%T) must return %v, but actual value is %v", i+1, expected, item.data, data)
 			continue
 		}
@@ -1099,64 +1106,47 @@ func Test_Func(t *testing.T) {
 	runTests(items, reg, t)
 }
 
-func Test_StructWithoutTags(t *testing.T) {
+func Test_Array(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
-			testStruct1{
-				123,
-				true,
-				"abc",
-				0,
-				"abc",
-			},
+			[0]bool{},
+			[]byte{version, typeId([0]bool{}), meta_cntr},
+			nil,
+		},
+		// #2
+		{
+			[4]byte{1, 2, 3, 4},
+			[]byte{version, typeId([4]byte{}), meta_cntr, 1, 2, 3, 4},
+			nil,
+		},
+		// #3
+		{
+			testArray{1, 2, 3},
+			[]byte{version, typeId(testArray{}), meta_cntr, 0b0001_0000 | 2, 0b0001_0000 | 4, 0b0001_0000 | 6},
+			nil,
+		},
+		// #4
+		{
+			[3]any{"a", nil, [1]bool{true}},
 			[]byte{
 				version,
-				typeId(testStruct1{}), meta_cntr, // testStruct1 header
-				0b0010_0000, 246,       // testStruct1.f1 (id = 1)
-				meta_tru,               // testStruct1.f2 (id = 3)
-				c2b0(3), 'a', 'b', 'c', // testStruct1.F3 (id = 5)
-				0,                      // testStruct1.F4 (id = 7)
-				meta_ref, c2b0(6),      // ref to testStruct1.F3 (id = 9)
+				typeId([3]any{}), meta_cntr,
+				typeId(""), c2b0(1), 'a',
+				typeId(nil), meta_nil,
+				typeId([1]bool{}), meta_cntr, meta_tru,
 			},
 			nil,
 		},
-		// #2
+		// #5
 		{
-			testStruct2{
-				testStruct1{
-					111,
-					true,
-					"abcde",
-					0,
-					"",
-				},
-				nil,
-				testStruct1{
-					0,
-					false,
-					"",
-					128,
-					"abcde",
-				},
-			},
+			[2][]int{{1}, nil},
 			[]byte{
 				version,
-				typeId(testStruct2{}), meta_cntr, // testStruct2 header
-				typeId(testStruct1{}), meta_cntr, // testStruct2.f1 (id = 2)
-			    0b0010_0000, 222,                 // testStruct2.f1.f1 (id = 4)
-				meta_tru,                         // testStruct2.f1.f2 (id = 6)
-				c2b0(5), 'a', 'b', 'c', 'd', 'e', // testStruct2.f1.F3 (id = 8)
-				0,                                // testStruct2.f1.F4 (id = 10)
-				c2b0(0),                          // testStruct2.f1.f5 (id = 12)
-				typeId(nil), meta_nil,            // testStruct2.f2
-				typeId(testStruct1{}), meta_cntr, // testStruct2.f3
-				0b0001_0000,                      // testStruct2.f3.f1
-				meta_fls,                         // testStruct2.f3.f2
-				meta_ref, c2b0(13),               // testStruct2.f3.F3
-				128,                              // testStruct2.f3.F4
-				meta_ref, c2b0(9),                // testStruct2.f3.f5
+				typeId([2][]int{}), meta_cntr,
+				meta_nonil, c2b0(1), c2b0(1), 0b0001_0000 | 2,
+				meta_nil,
 			},
 			nil,
 		},
@@ -1164,213 +1154,329 @@ func Test_StructWithoutTags(t *testing.T) {
 	runTests(items, reg, t)
 }
 
-func Test_ReferenceToTheSameValue(t *testing.T) {
+func Test_PointerToArrayElement(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
 			func() any {
-				s := testStruct2{}
-				s.f1 = registry
-				s.f2 = registry
+				s := &testStruct2{}
+				a := [2]int{1, 2}
+				s.f1 = &a
+				s.f2 = &a[1]
 				return s
 			}(),
 			[]byte{
-				version,
-				typeId(testStruct2{}), meta_cntr, // testStruct2 header
-				typeId(registry), meta_nonil,     // testStruct1.f1 (id = 1)
-				meta_ref, c2b0(3),                // testStruct2.f2 (id = 4)
-				typeId(nil), meta_nil,            // testStruct2.f3 (id = 7)
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*[2]int)(nil)), meta_nonil, meta_cntr, 0b0001_0000 | 2, 0b0001_0000 | 4, // f1
+				typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(8), // f2 is &(*f1)[1]
+				typeId(nil), meta_nil, // f3
 			},
 			func(expected, actual any) bool {
-				e := expected.(testStruct2)
-				a := actual.(testStruct2)
-				return funcEqual(e.f1, a.f1) && funcEqual(e.f2, a.f2) && a.f3 == nil
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f1.(*[2]int)[1] = 5
+				return *s.f2.(*int) == 5
 			},
 		},
 		// #2
 		{
 			func() any {
-				ch := make(chan<- byte, 15)
-				s := testStruct2{}
-				s.f2 = ch
-				s.f3 = ch
+				s := &testStruct2{}
+				a := [2]int{1, 2}
+				s.f1 = &a[0]
+				s.f2 = &a
 				return s
 			}(),
 			[]byte{
-				version,
-				typeId(testStruct2{}), meta_cntr, // testStruct2 header
-				typeId(nil), meta_nil, // testStruct1.f1 (id = 1)
-				typeId((chan<- byte)(nil)), meta_nonil, c2b0(15), // testStruct2.f2 (id = 4)
-				meta_ref, c2b0(6), // testStruct2.f3 (id = 7)
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(9), // f1 is &(*f2)[0]
+				typeId((*[2]int)(nil)), meta_nonil, meta_cntr, 0b0001_0000 | 2, 0b0001_0000 | 4, // f2
+				typeId(nil), meta_nil, // f3
 			},
 			func(expected, actual any) bool {
-				e := expected.(testStruct2)
-				a := actual.(testStruct2)
-				return chanEqual(e.f2, a.f2) && chanEqual(e.f3, a.f3) && a.f1 == nil
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f2.(*[2]int)[0] = 5
+				return *s.f1.(*int) == 5
+			},
+		},
+		// #3
+		{
+			func() any {
+				a := &[3]any{}
+				a[0] = &a[2]
+				a[1] = &a[0]
+				a[2] = "abc"
+				return a
+			}(),
+			[]byte{
+				version, typeId((*[3]any)(nil)), meta_nonil, meta_cntr,
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(8), // [0] is &[2]
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // [1] is &[0]
+				typeId(""), c2b0(3), 'a', 'b', 'c', // [2]
+			},
+			func(expected, actual any) bool {
+				a := actual.(*[3]any)
+				return a[2] == "abc" && a[0].(*any) == &a[2] && a[1].(*any) == &a[0]
 			},
 		},
 	}
 	runTests(items, reg, t)
 }
 
-func Test_PointerToSingleValue(t *testing.T) {
+func Test_Slice(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
-			(*any)(nil),
-			[]byte{version, typeId((*any)(nil)), meta_nil},
+			([]string)(nil),
+			[]byte{version, typeId([]string{}), meta_nil},
 			nil,
 		},
 		// #2
 		{
-			(*byte)(nil),
-			[]byte{version, typeId((*byte)(nil)), meta_nil},
+			[]bool{},
+			[]byte{version, typeId([]bool{}), meta_nonil, c2b0(0), c2b0(0)},
 			nil,
 		},
 		// #3
 		{
-			func() any {
-				b := true
-				return &b
-			}(),
-			[]byte{version, typeId((*bool)(nil)), meta_nonil, meta_tru},
+			[]byte{1, 2, 3},
+			[]byte{version, typeId([]byte{}), meta_nonil, c2b0(3), c2b0(3), 1, 2, 3},
 			nil,
 		},
 		// #4
 		{
-			func() any {
-				b := byte(255)
-				return &b
-			}(),
-			[]byte{version, typeId((*byte)(nil)), meta_nonil, 255},
-			nil,
+			make([]int8, 1, 4),
+			[]byte{version, typeId([]int8{}), meta_nonil, c2b0(1), c2b0(4), 0},
+			func(expected, actual any) bool {
+				return defaultEq(expected, actual) && cap(actual.([]int8)) == 4
+			},
 		},
 		// #5
 		{
-			func() any {
-				s := "123"
-				return &s
-			}(),
-			[]byte{version, typeId((*string)(nil)), meta_nonil, 0b0001_0000 | 3, '1', '2', '3'},
+			[]any{uint16(1), true, nil, "ab"},
+			[]byte{
+				version,
+				typeId([]any{}), meta_nonil, c2b0(4), c2b0(4),
+				typeId(uint16(0)), 0b0100_0000 | 1,
+				typeId(false), meta_tru,
+				typeId(nil), meta_nil,
+				typeId(""), c2b0(2), 'a', 'b',
+			},
 			nil,
 		},
 		// #6
 		{
-			func() any {
-				var x any = true
-				return &x
-			}(),
-			[]byte{version, typeId((*any)(nil)), meta_nonil, typeId(false), meta_tru},
+			testRecSlice{testRecSlice{nil}, nil},
+			[]byte{
+				version,
+				typeId(testRecSlice{}), meta_nonil, c2b0(2), c2b0(2),
+				meta_nonil, c2b0(1), c2b0(1), meta_nil,
+				meta_nil,
+			},
 			nil,
 		},
 		// #7
 		{
 			func() any {
-				b := true
-				return testBoolPtr(&b)
+				s := "abc"
+				return []string{s, s[:2], s}
 			}(),
-			[]byte{version, typeId(testBoolPtr(nil)), meta_nonil, meta_tru},
+			[]byte{
+				version,
+				typeId([]string{}), meta_nonil, c2b0(3), c2b0(3),
+				c2b0(3), 'a', 'b', 'c', // [0] (id = 2)
+				c2b0(2), 'a', 'b', // [1]
+				meta_ref, c2b0(2), // [2] is ref to [0]
+			},
 			nil,
 		},
+		// #8
+		{
+			func() any {
+				s := []int{1, 2, 3}
+				return []any{s, s[:2], s}
+			}(),
+			[]byte{
+				version,
+				typeId([]any{}), meta_nonil, c2b0(3), c2b0(3),
+				typeId([]int{}), meta_nonil, c2b0(3), c2b0(3), 0b0001_0000 | 2, 0b0001_0000 | 4, 0b0001_0000 | 6, // [0] (id = 3)
+				typeId([]int{}), meta_nonil, c2b0(2), c2b0(3), 0b0001_0000 | 2, 0b0001_0000 | 4, // [1]
+				meta_ref, c2b0(3), // [2] is ref to [0]
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				a := actual.([]any)
+				a[0].([]int)[0] = 10
+				return a[2].([]int)[0] == 10 && a[1].([]int)[0] == 1
+			},
+		},
 	}
 	runTests(items, reg, t)
 }
 
-func Test_PointersToTheSameValue(t *testing.T) {
+func Test_PointerToSliceElement(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
 			func() any {
-				b1 := byte(1)
-				b2 := byte(1)
 				s := &testStruct2{}
-				s.f1 = &b1
-				s.f2 = &b2
-				s.f3 = &b1
+				l := []int{1, 2}
+				s.f1 = l
+				s.f2 = &l[1]
 				return s
 			}(),
 			[]byte{
 				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f1 (id = 2)
-				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f2 (id = 6)
-				meta_ref, c2b0(4), // testStruct2.f3 is ref to f1 value (id = 10)
+				typeId([]int{}), meta_nonil, c2b0(2), c2b0(2), // f1 (id = 4)
+				0b0001_0000 | 2,   // f1[0] (id = 5)
+				0b0001_0000 | 4,   // f1[1] (id = 7)
+				typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(7), // f2 is &f1[1]
+				typeId(nil), meta_nil, // f3
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f1.([]int)[1] = 5
+				return *s.f2.(*int) == 5
 			},
-			nil,
 		},
 		// #2
 		{
 			func() any {
-				b := byte(1)
 				s := &testStruct2{}
-				s.f2 = &b
-				s.f3 = &b
+				l := []int{1, 2}
+				s.f1 = &l[1]
+				s.f2 = l
 				return s
 			}(),
 			[]byte{
 				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId(nil), meta_nil, // testStruct2.f1 (id = 2)
-				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f2 (id = 5)
-				meta_ref, c2b0(7), // testStruct2.f3 is ref to f2 value (id = 9)
+				typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(10), // f1 is &f2[1]
+				typeId([]int{}), meta_nonil, c2b0(2), c2b0(2), // f2 (id = 5)
+				0b0001_0000 | 2, // f2[0] (id = 8)
+				0b0001_0000 | 4, // f2[1] (id = 10)
+				typeId(nil), meta_nil, // f3
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f2.([]int)[1] = 5
+				return *s.f1.(*int) == 5
 			},
-			nil,
 		},
 		// #3
 		{
 			func() any {
-				s := &testStruct2{}
-				s.f1 = s
-				s.f2 = s
-				return s
+				l := []int{1, 2}
+				return []any{&l[0], []any{l, true}}
 			}(),
 			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				meta_ref, c2b0(0), // testStruct2.f1 (id = 2) is ref to struct
-				meta_ref, c2b0(0), // testStruct2.f2 (id = 5) is ref to struct
-				typeId(nil), meta_nil, // testStruct2.f3
+				version,
+				typeId([]any{}), meta_nonil, c2b0(2), c2b0(2),
+				typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(10), // [0] is &[1][0][0]
+				typeId([]any{}), meta_nonil, c2b0(2), c2b0(2), // [1]
+				typeId([]int{}), meta_nonil, c2b0(2), c2b0(2), 0b0001_0000 | 2, 0b0001_0000 | 4, // [1][0]
+				typeId(false), meta_tru, // [1][1]
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				a := actual.([]any)
+				a[1].([]any)[0].([]int)[0] = 5
+				return *a[0].(*int) == 5
 			},
-			nil,
 		},
 	}
 	runTests(items, reg, t)
 }
 
-func Test_PointerChain(t *testing.T) {
+func Test_Map(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
-			func() any {
-				var x1, x2 any
-				y := byte(111)
-				x1 = &x2
-				x2 = &y
-				return x1
-			}(),
+			(map[byte]bool)(nil),
+			[]byte{version, typeId((map[byte]bool)(nil)), meta_nil},
+			nil,
+		},
+		// #2
+		{
+			map[string]int{},
+			[]byte{version, typeId((map[string]int)(nil)), meta_nonil, c2b0(0)},
+			nil,
+		},
+		// #3
+		{
+			map[string]byte{"a": 1},
+			[]byte{version, typeId((map[string]byte)(nil)), meta_nonil, c2b0(1), c2b0(1), 'a', 1},
+			nil,
+		},
+		// #4
+		{
+			testRecMap{8: testRecMap(nil)},
+			[]byte{version, typeId(testRecMap(nil)), meta_nonil, c2b0(1), 8, meta_nil},
+			nil,
+		},
+		// #5
+		{
+			map[any]any{true: nil},
 			[]byte{
 				version,
-				typeId((*any)(nil)), meta_nonil, // x1
-				typeId((*byte)(nil)), meta_nonil, 111, // x2
+				typeId((map[any]any)(nil)), meta_nonil, c2b0(1),
+				typeId(false), meta_tru,
+				typeId(nil), meta_nil,
 			},
 			nil,
 		},
-		// #2
+		// #6
+		{
+			map[string]any{
+				"a": 1,
+				"b": "ab",
+				"c": []any{true, nil},
+				"d": map[string]any{"e": 1.5},
+				"f": nil,
+			},
+			nil,
+			nil,
+		},
+		// #7
+		{
+			map[any]any{
+				int8(1):  "a",
+				"b":      uint16(2),
+				nil:      testMap{"c": 3},
+				[2]int{}: []any{},
+			},
+			nil,
+			nil,
+		},
+		// #8
 		{
 			func() any {
-				var x1, x2, x3 any
-				y := byte(111)
-				x1 = &x2
-				x2 = &x3
-				x3 = &y
-				return x1
+				s := "abc"
+				return map[string]string{s: s}
 			}(),
 			[]byte{
 				version,
-				typeId((*any)(nil)), meta_nonil, // x1
-				typeId((*any)(nil)), meta_nonil, // x2
-				typeId((*byte)(nil)), meta_nonil, 111, // x3
+				typeId((map[string]string)(nil)), meta_nonil, c2b0(1),
+				c2b0(3), 'a', 'b', 'c', // key (id = 1)
+				meta_ref, c2b0(1), // value is ref to key
 			},
 			nil,
 		},
@@ -1378,471 +1484,1683 @@ func Test_PointerChain(t *testing.T) {
 	runTests(items, reg, t)
 }
 
-func Test_CyclicPointerChain(t *testing.T) {
+func Test_SharedMap(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
 			func() any {
-				var x any
-				x = &x
-				return x
+				m := map[string]bool{"a": true}
+				return &testStruct2{m, m, &m}
 			}(),
-			[]byte{version, typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0)},
-			func(_, actual any) bool {
-				v := actual.(*any)
-				return v == *v
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((map[string]bool)(nil)), meta_nonil, c2b0(1), c2b0(1), 'a', meta_tru, // f1 (id = 4)
+				meta_ref, c2b0(4), // f2 is ref to f1
+				typeId((*map[string]bool)(nil)), meta_nonil, meta_ref, c2b0(4), // f3 points to f1
 			},
-		},
-		// #2
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f1.(map[string]bool)["b"] = true
+				return s.f2.(map[string]bool)["b"] && (*s.f3.(*map[string]bool))["b"]
+			},
+		},
+		// #2
 		{
 			func() any {
-				var x1, x2 any
-				x1 = &x2
-				x2 = &x1
-				return x1
+				m := map[string]any{}
+				m["self"] = m
+				return m
 			}(),
 			[]byte{
-				version,
-				typeId((*any)(nil)), meta_nonil, // x1
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0), // x2
+				version, typeId((map[string]any)(nil)), meta_nonil, c2b0(1),
+				c2b0(4), 's', 'e', 'l', 'f', // key (id = 1)
+				meta_ref, c2b0(0), // value is ref to the map
 			},
 			func(_, actual any) bool {
-				x1 := actual.(*any)
-				x2 := (*x1).(*any)
-				return *x2 == x1 && x2 != x1
+				m := actual.(map[string]any)
+				m["x"] = 1
+				return m["self"].(map[string]any)["x"] == 1
 			},
 		},
 		// #3
 		{
 			func() any {
-				var x1, x2, x3 any
-				x1 = &x2
-				x2 = &x3
-				x3 = &x1
-				return x1
+				s := &testStruct2{}
+				s.f1 = map[string]any{"p": &s.f3}
+				s.f2 = map[string]*any{"p": &s.f3}
+				s.f3 = "abc"
+				return s
 			}(),
+			nil,
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f3 = 123
+				return *s.f1.(map[string]any)["p"].(*any) == 123 && *s.f2.(map[string]*any)["p"] == 123
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_StructWithoutTags(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			testStruct6{
+				123,
+				true,
+				"abc",
+				0,
+				"abc",
+			},
 			[]byte{
 				version,
-				typeId((*any)(nil)), meta_nonil, // x1
-				typeId((*any)(nil)), meta_nonil, // x2
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0), // x3
-			},
-			func(_, actual any) bool {
-				x1 := actual.(*any)
-				x2 := (*x1).(*any)
-				x3 := (*x2).(*any)
-				return *x3 == x1 && x1 != x2 && x2 != x3
+				typeId(testStruct6{}), meta_cntr, // testStruct6 header
+				0b0010_0000, 246,       // testStruct6.f1 (id = 1)
+				meta_tru,               // testStruct6.f2 (id = 3)
+				c2b0(3), 'a', 'b', 'c', // testStruct6.F3 (id = 5)
+				0,                      // testStruct6.F4 (id = 7)
+				meta_ref, c2b0(6),      // ref to testStruct6.F3 (id = 9)
 			},
+			nil,
 		},
-		// #4
+		// #2
 		{
-			func() any {
-				var x testRecPtr
-				x = &x
-				return x
-			}(),
-			[]byte{version, typeId(testRecPtr(nil)), meta_nonil, meta_ref, c2b0(0)},
-			func(_, actual any) bool {
-				v := actual.(testRecPtr)
-				return v == *v
+			testStruct2{
+				testStruct6{
+					111,
+					true,
+					"abcde",
+					0,
+					"",
+				},
+				nil,
+				testStruct6{
+					0,
+					false,
+					"",
+					128,
+					"abcde",
+				},
+			},
+			[]byte{
+				version,
+				typeId(testStruct2{}), meta_cntr, // testStruct2 header
+				typeId(testStruct6{}), meta_cntr, // testStruct2.f1 (id = 2)
+			    0b0010_0000, 222,                 // testStruct2.f1.f1 (id = 4)
+				meta_tru,                         // testStruct2.f1.f2 (id = 6)
+				c2b0(5), 'a', 'b', 'c', 'd', 'e', // testStruct2.f1.F3 (id = 8)
+				0,                                // testStruct2.f1.F4 (id = 10)
+				c2b0(0),                          // testStruct2.f1.f5 (id = 12)
+				typeId(nil), meta_nil,            // testStruct2.f2
+				typeId(testStruct6{}), meta_cntr, // testStruct2.f3
+				0b0001_0000,                      // testStruct2.f3.f1
+				meta_fls,                         // testStruct2.f3.f2
+				meta_ref, c2b0(13),               // testStruct2.f3.F3
+				128,                              // testStruct2.f3.F4
+				meta_ref, c2b0(9),                // testStruct2.f3.f5
 			},
+			nil,
 		},
-		// #5
+	}
+	runTests(items, reg, t)
+}
+
+func Test_StructWithTags(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
 		{
-			func() any {
-				var x1, x2 testRecPtr
-				x1 = &x2
-				x2 = &x1
-				return x1
-			}(),
+			testStruct1{
+				123,
+				true,
+				"abc",
+				0,
+				"abc",
+			},
 			[]byte{
 				version,
-				typeId(testRecPtr(nil)), meta_nonil, // x1
-				meta_nonil, meta_ref, c2b0(0), // x2
+				typeId(testStruct1{}), meta_cntr, c2b0(5), // testStruct1 header
+				meta_fls,               // testStruct1.f2 is removed (id = 2)
+				0b0010_0000, 246,       // testStruct1.f1 (id = 4)
+				c2b0(3), 'a', 'b', 'c', // testStruct1.f5 (id = 6)
+				0,                      // testStruct1.F4 (id = 8)
+				meta_ref, c2b0(6),      // testStruct1.F3 is ref to testStruct1.f5
 			},
-			func(_, actual any) bool {
-				x1 := actual.(testRecPtr)
-				x2 := *x1
-				return *x2 == x1 && x2 != x1
+			func(expected, actual any) bool {
+				s := expected.(testStruct1)
+				s.f2 = false
+				return defaultEq(s, actual)
 			},
 		},
-		// #6
+		// #2
 		{
-			func() any {
-				var x1, x2, x3 testRecPtr
-				x1 = &x2
-				x2 = &x3
-				x3 = &x1
-				return x1
-			}(),
+			testStruct7{
+				f1: 5,
+				f2: "abc",
+				f3: 7,
+				f4: []byte{1},
+				f5: 1.5,
+			},
 			[]byte{
 				version,
-				typeId(testRecPtr(nil)), meta_nonil, // x1
-				meta_nonil,                    // x2
-				meta_nonil, meta_ref, c2b0(0), // x3
+				typeId(testStruct7{}), meta_cntr, c2b0(4), // testStruct7 header
+				0,                                         // testStruct7.f1 is migrated
+				c2b0(0),                                   // testStruct7.f2 is removed
+				0b0001_0000 | 14,                          // testStruct7.f3
+				meta_nonil, c2b0(1), c2b0(1), 1,           // testStruct7.f4
 			},
-			func(_, actual any) bool {
-				x1 := actual.(testRecPtr)
-				x2 := *x1
-				x3 := *x2
-				return *x3 == x1 && x1 != x2 && x2 != x3
+			func(expected, actual any) bool {
+				return defaultEq(testStruct7{f3: 7, f4: []byte{1}}, actual)
 			},
 		},
-		// #7
+	}
+	runTests(items, reg, t)
+}
+
+func Test_StructMigration(t *testing.T) {
+	reg, typeId := registry()
+	unserializer := NewUnserializer().WithTypeRegistry(reg)
+	items := []struct {
+		data     []byte
+		expected any
+	}{
+		// #1: f3 and f4 had not been added yet
 		{
-			func() any {
-				var x1 any
-				var x2 *any
-				var x3 **any
-				x2 = &x1
-				x3 = &x2
-				x1 = x3
-				return x3
-			}(),
 			[]byte{
 				version,
-				typeId((**any)(nil)), meta_nonil, // x3
-				meta_nonil,        // x2
-				meta_ref, c2b0(0), // x1 == x3
-			},
-			func(_, actual any) bool {
-				x3 := actual.(**any)
-				x2 := *x3
-				x1 := *x2
-				return x1 == x3
+				typeId(testStruct7{}), meta_cntr, c2b0(2),
+				10,               // f1
+				c2b0(1), 'a',     // f2
 			},
+			testStruct7{f3: 5},
 		},
-		// #8
+		// #2: f4 had not been added yet
 		{
-			func() any {
-				var x1 any
-				var x2 *any
-				var x3 **any
-				x2 = &x1
-				x3 = &x2
-				x1 = &x3
-				return x3
-			}(),
 			[]byte{
 				version,
-				typeId((**any)(nil)), meta_nonil, // x3
-				meta_nonil,                                           // x2
-				typeId((***any)(nil)), meta_nonil, meta_ref, c2b0(0), // x1 == x3
-			},
-			func(_, actual any) bool {
-				x3 := actual.(**any)
-				x2 := *x3
-				x1 := *x2
-				return *x1.(***any) == x3
+				typeId(testStruct7{}), meta_cntr, c2b0(3),
+				0,                // f1
+				c2b0(1), 'a',     // f2
+				0b0001_0000 | 14, // f3
 			},
+			testStruct7{f3: 7},
 		},
 	}
-	runTests(items, reg, t)
+	for i, item := range items {
+		actual, err := unserializer.Decode(item.data)
+		if err != nil {
+			t.Errorf("Test #%d: Decode(%v) raises error: %q", i+1, item.data, err)
+		} else if !defaultEq(item.expected, actual) {
+			t.Errorf("Test #%d: Decode(%v) must return %v, but actual value is %v", i+1, item.data, item.expected, actual)
+		}
+	}
 }
 
-func Test_BackwardPointerToContainer(t *testing.T) {
+func Test_StructCodingModeName(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
-			func() any {
-				s := &testStruct2{
-					f1: true,
-				}
-				s.f2 = &s.f1
-				s.f3 = &s.f1
-				return s
-			}(),
-			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId(false), meta_tru, // f1 (id = 3)
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
-				meta_ref, c2b0(7), // f3 is *f1
+			testStruct6{
+				123,
+				true,
+				"abc",
+				0,
+				"abc",
 			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f1 = false
-				return *s.f2.(*any) == false && *s.f3.(*any) == false
+			[]byte{
+				version,
+				typeId(testStruct6{}), meta_cntr, c2b0(5), // testStruct6 header
+				c2b0(2), 'f', '1', c2b0(2), 0b0101_0000, 0, 0, 0, 2, 0b0010_0000, 246, // testStruct6.f1 (id = 2) takes 2 ids and 2 bytes (size is padded to 5 bytes)
+				c2b0(2), 'f', '2', c2b0(2), 0b0101_0000, 0, 0, 0, 1, meta_tru, // testStruct6.f2 (id = 4)
+				c2b0(2), 'F', '3', c2b0(2), 0b0101_0000, 0, 0, 0, 4, c2b0(3), 'a', 'b', 'c', // testStruct6.F3 (id = 6)
+				c2b0(2), 'F', '4', c2b0(2), 0b0101_0000, 0, 0, 0, 1, 0, // testStruct6.F4 (id = 8)
+				c2b0(2), 'f', '5', c2b0(1), 0b0101_0000, 0, 0, 0, 2, meta_ref, c2b0(6), // testStruct6.f5 is ref to testStruct6.F3
 			},
+			nil,
 		},
 		// #2
 		{
-			func() any {
-				b := true
-				s := &testStruct3{
-					f1: &b,
-				}
-				s.f2 = &s.f1
-				s.f3 = &s.f1
-				return s
-			}(),
+			testStruct7{
+				f1: 5,
+				f2: "abc",
+				f3: 7,
+				f4: []byte{1},
+				f5: 1.5,
+			},
 			[]byte{
-				version, typeId((*testStruct3)(nil)), meta_nonil, meta_cntr, // *testStruct3
-				meta_nonil, meta_tru, // f1 (id = 3)
-				typeId((**bool)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
-				meta_ref, c2b0(7), // f3 is *f1
+				version,
+				typeId(testStruct7{}), meta_cntr, c2b0(2), // testStruct7 header
+				c2b0(2), 'f', '3', c2b0(2), 0b0101_0000, 0, 0, 0, 1, 0b0001_0000 | 14, // testStruct7.f3
+				c2b0(2), 'f', '4', c2b0(4), 0b0101_0000, 0, 0, 0, 4, meta_nonil, c2b0(1), c2b0(1), 1, // testStruct7.f4
 			},
 			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct3)
-				s.f1 = nil
-				return *s.f2.(**bool) == nil && *s.f3.(**bool) == nil
+				return defaultEq(testStruct7{f3: 7, f4: []byte{1}}, actual)
 			},
 		},
 		// #3
 		{
 			func() any {
-				var x any = true
-				s := &testStruct4{
-					f1: &x,
-				}
-				s.f2 = &s.f1
-				s.f3 = &s.f1
+				s := &testStruct4{}
+				s.f1 = &s.f3
+				s.f2 = []any{&s.f2}
+				s.f3 = "abc"
 				return s
 			}(),
-			[]byte{
-				version, typeId((*testStruct4)(nil)), meta_nonil, meta_cntr, // *testStruct4
-				meta_nonil, typeId(false), meta_tru, // f1 (id = 3)
-				typeId((**any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
-				meta_ref, c2b0(8), // f3 is *f1
-			},
+			nil,
 			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
 				s := actual.(*testStruct4)
-				*s.f1 = byte(123)
-				return **s.f2.(**any) == *s.f1 && **s.f3.(**any) == *s.f1
+				return s.f1 == &s.f3 && s.f3 == "abc" && s.f2.([]any)[0] == &s.f2
 			},
 		},
-		// #4
+	}
+	runTests(items, reg, t, StructCodingModeName)
+
+	unserializer := NewUnserializer().WithOptions([]any{reg, StructCodingModeName})
+	decodeItems := []struct {
+		data     []byte
+		expected any
+	}{
+		// #1: fields are reordered
 		{
-			func() any {
-				s := &testStruct2{}
-				s.f1 = s
-				s.f2 = &s.f1
-				s.f3 = &s.f1
-				return s
-			}(),
 			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				meta_ref, c2b0(0), // f1 is ref to s (id = 3)
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 5)
-				meta_ref, c2b0(6), // f3 is ref to f2 value
-			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f1 = byte(123)
-				return *s.f2.(*any) == s.f1 && *s.f3.(*any) == s.f1
+				version,
+				typeId(testStruct6{}), meta_cntr, c2b0(3),
+				c2b0(2), 'F', '4', c2b0(2), 0b0101_0000, 0, 0, 0, 1, 7,
+				c2b0(2), 'f', '2', c2b0(2), 0b0101_0000, 0, 0, 0, 1, meta_tru,
+				c2b0(2), 'f', '1', c2b0(2), 0b0101_0000, 0, 0, 0, 1, 0b0001_0000 | 2,
 			},
+			testStruct6{f1: 1, f2: true, F4: 7},
 		},
-		// #5
+		// #2: f1 is migrated, f3 had not been added yet
 		{
-			func() any {
-				s := &testStruct2{}
-				s.f1 = &s.f1
-				return s
-			}(),
 			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f1 is ref to f1 (id = 3)
-				typeId(nil), meta_nil, // f2
-				typeId(nil), meta_nil, // f3
+				version,
+				typeId(testStruct7{}), meta_cntr, c2b0(2),
+				c2b0(2), 'f', '2', c2b0(2), 0b0101_0000, 0, 0, 0, 2, c2b0(1), 'a',
+				c2b0(2), 'f', '1', c2b0(2), 0b0101_0000, 0, 0, 0, 1, 10,
 			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				return *s.f1.(*any) == s.f1 && s.f1 != s
+			testStruct7{f3: 5},
+		},
+		// #3: unknown field X is skipped with its ids, so f5 refers to F3 by the id following them
+		{
+			[]byte{
+				version,
+				typeId(testStruct6{}), meta_cntr, c2b0(3),
+				c2b0(1), 'X', c2b0(2), 0b0101_0000, 0, 0, 0, 3, c2b0(2), 'a', 'b',
+				c2b0(2), 'F', '3', c2b0(2), 0b0101_0000, 0, 0, 0, 4, c2b0(3), 'a', 'b', 'c',
+				c2b0(2), 'f', '5', c2b0(1), 0b0101_0000, 0, 0, 0, 2, meta_ref, c2b0(4),
 			},
+			testStruct6{F3: "abc", f5: "abc"},
 		},
 	}
-	runTests(items, reg, t)
+	for i, item := range decodeItems {
+		actual, err := unserializer.Decode(item.data)
+		if err != nil {
+			t.Errorf("Test #%d: Decode(%v) raises error: %q", i+1, item.data, err)
+		} else if !defaultEq(item.expected, actual) {
+			t.Errorf("Test #%d: Decode(%v) must return %v, but actual value is %v", i+1, item.data, item.expected, actual)
+		}
+	}
 }
 
-func Test_ForwardPointerToContainer(t *testing.T) {
+func Test_StructCodingModeNameUnknownFields(t *testing.T) {
+	producer := NewTypeRegistry(false)
+	producer.RegisterBaseTypes()
+	producer.RegisterTypeOf(&testStruct8{})
+	producer.RegisterTypeOf([]any{})
+	producer.RegisterTypeOf(new(string)) // types of the unknown fields
+	producer.RegisterTypeOf(new(int))
+	consumer := NewTypeRegistry(false)
+	consumer.RegisterBaseTypes()
+	consumer.RegisterTypeOf(&testStruct6{})
+	consumer.RegisterTypeOf([]any{})
+
+	v := &testStruct8{f1: 1, F3: "abc", F4: 2, f5: "def"}
+	v.f6 = []any{1, strings.Repeat("x", 2*flushSize), &v.F3, &v.f1}
+	v.f7 = &v.f5
+	expected := testStruct6{f1: 1, F3: "abc", F4: 2, f5: "def"}
+	data := Serialize(v, producer, StructCodingModeName)
+	if actual, err := UnserializeAs[*testStruct6](data, consumer, StructCodingModeName); err != nil || *actual != expected {
+		t.Errorf("Unserialize(%v) must skip unknown fields, but returns %v (err: %v)", data, actual, err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).WithTypeRegistry(producer).WithStructCodingMode(StructCodingModeName).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	var actual *testStruct6
+	if err := NewDecoder(&buf).WithTypeRegistry(consumer).WithStructCodingMode(StructCodingModeName).DecodeInto(&actual); err != nil || *actual != expected {
+		t.Errorf("Decoder must skip unknown fields of the stream, but returns %v (err: %v)", actual, err)
+	}
+
+	// values of unknown fields cannot be referenced
+	v.f5 = strings.Repeat("g", 3)
+	v.f6 = []any{v.f5}
+	data = Serialize(v, producer, StructCodingModeName)
+	if _, err := Unserialize(data, consumer, StructCodingModeName); !errors.Is(err, ErrBadReference) {
+		t.Errorf("Unserialize(%v) must return error %q, but actual error is %v", data, ErrBadReference, err)
+	}
+}
+
+func Test_ReferenceToTheSameValue(t *testing.T) {
 	reg, typeId := registry()
 	items := []testItem{
 		// #1
 		{
 			func() any {
-				s := &testStruct2{}
-				x := &s.f3
-				s.f1 = &x
+				s := testStruct2{}
+				s.f1 = registry
+				s.f2 = registry
 				return s
 			}(),
 			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(9), // f1 is ref to f3 (id = 2)
-				typeId(nil), meta_nil, // f2 (id = 7)
-				typeId(nil), meta_nil, // f3 (id = 9)
+				version,
+				typeId(testStruct2{}), meta_cntr, // testStruct2 header
+				typeId(registry), meta_nonil,     // testStruct1.f1 (id = 1)
+				meta_ref, c2b0(3),                // testStruct2.f2 (id = 4)
+				typeId(nil), meta_nil,            // testStruct2.f3 (id = 7)
 			},
 			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f3 = byte(123)
-				return **s.f1.(**any) == s.f3 && s.f3 == byte(123)
+				e := expected.(testStruct2)
+				a := actual.(testStruct2)
+				return funcEqual(e.f1, a.f1) && funcEqual(e.f2, a.f2) && a.f3 == nil
 			},
 		},
 		// #2
 		{
 			func() any {
-				s := &testStruct2{}
-				x := &s.f3
-				s.f1 = &x
-				s.f2 = &x
+				ch := make(chan<- byte, 15)
+				s := testStruct2{}
+				s.f2 = ch
+				s.f3 = ch
 				return s
 			}(),
 			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(8), // f1 is ref to f3 (id = 2)
-				meta_ref, c2b0(4), // f2 (id = 6)
-				typeId(nil), meta_nil, // f3 (id = 8)
+				version,
+				typeId(testStruct2{}), meta_cntr, // testStruct2 header
+				typeId(nil), meta_nil, // testStruct1.f1 (id = 1)
+				typeId((chan<- byte)(nil)), meta_nonil, c2b0(15), // testStruct2.f2 (id = 4)
+				meta_ref, c2b0(6), // testStruct2.f3 (id = 7)
 			},
 			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f3 = byte(123)
-				return **s.f1.(**any) == s.f3 && **s.f2.(**any) == s.f3 && s.f3 == byte(123)
+				e := expected.(testStruct2)
+				a := actual.(testStruct2)
+				return chanEqual(e.f2, a.f2) && chanEqual(e.f3, a.f3) && a.f1 == nil
 			},
 		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_PointerToSingleValue(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			(*any)(nil),
+			[]byte{version, typeId((*any)(nil)), meta_nil},
+			nil,
+		},
+		// #2
+		{
+			(*byte)(nil),
+			[]byte{version, typeId((*byte)(nil)), meta_nil},
+			nil,
+		},
 		// #3
 		{
 			func() any {
-				s := &testStruct2{}
-				x := &s.f2
-				s.f1 = &x
-				s.f3 = &x
-				return s
+				b := true
+				return &b
 			}(),
-			[]byte{
-				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(6), // f1 is ref to f2 (id = 2)
-				typeId(nil), meta_nil, // f2 (id = 6)
-				meta_ref, c2b0(4), // f3 (id = 8)
-
-			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f2 = byte(123)
-				return **s.f1.(**any) == s.f2 && **s.f3.(**any) == s.f2 && s.f2 == byte(123)
-			},
+			[]byte{version, typeId((*bool)(nil)), meta_nonil, meta_tru},
+			nil,
 		},
 		// #4
 		{
 			func() any {
+				b := byte(255)
+				return &b
+			}(),
+			[]byte{version, typeId((*byte)(nil)), meta_nonil, 255},
+			nil,
+		},
+		// #5
+		{
+			func() any {
+				s := "123"
+				return &s
+			}(),
+			[]byte{version, typeId((*string)(nil)), meta_nonil, 0b0001_0000 | 3, '1', '2', '3'},
+			nil,
+		},
+		// #6
+		{
+			func() any {
+				var x any = true
+				return &x
+			}(),
+			[]byte{version, typeId((*any)(nil)), meta_nonil, typeId(false), meta_tru},
+			nil,
+		},
+		// #7
+		{
+			func() any {
+				b := true
+				return testBoolPtr(&b)
+			}(),
+			[]byte{version, typeId(testBoolPtr(nil)), meta_nonil, meta_tru},
+			nil,
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_PointersToTheSameValue(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			func() any {
+				b1 := byte(1)
+				b2 := byte(1)
 				s := &testStruct2{}
-				s.f1 = &s.f3
+				s.f1 = &b1
+				s.f2 = &b2
+				s.f3 = &b1
 				return s
 			}(),
 			[]byte{
 				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(8), // f1 is ref to f3 (id = 2)
-				typeId(nil), meta_nil, // f2 (id = 5)
-				typeId(nil), meta_nil, // f3 (id = 8)
-			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f3 = byte(123)
-				return *s.f1.(*any) == s.f3 && s.f3 == byte(123)
+				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f1 (id = 2)
+				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f2 (id = 6)
+				meta_ref, c2b0(4), // testStruct2.f3 is ref to f1 value (id = 10)
 			},
+			nil,
 		},
-		// #5
+		// #2
 		{
 			func() any {
+				b := byte(1)
 				s := &testStruct2{}
-				s.f1 = &s.f3
-				s.f2 = &s.f3
+				s.f2 = &b
+				s.f3 = &b
 				return s
 			}(),
 			[]byte{
 				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(7), // f1 is ref to f3 (id = 2)
-				meta_ref, c2b0(4), // f2 (id = 5)
-				typeId(nil), meta_nil, // f3 (id = 7)
-			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*testStruct2)
-				s.f3 = byte(123)
-				return *s.f1.(*any) == s.f3 && *s.f2.(*any) == s.f3 && s.f3 == byte(123)
+				typeId(nil), meta_nil, // testStruct2.f1 (id = 2)
+				typeId((*byte)(nil)), meta_nonil, 1, // testStruct2.f2 (id = 5)
+				meta_ref, c2b0(7), // testStruct2.f3 is ref to f2 value (id = 9)
 			},
+			nil,
 		},
-		// #6
+		// #3
 		{
 			func() any {
 				s := &testStruct2{}
-				s.f1 = &s.f2
-				s.f3 = &s.f2
+				s.f1 = s
+				s.f2 = s
 				return s
 			}(),
 			[]byte{
 				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
-				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(5), // f1 is ref to f2 (id = 2)
-				typeId(nil), meta_nil, // f2 (id = 5)
-				meta_ref, c2b0(4), // f3 (id = 7)
-
-			},
+				meta_ref, c2b0(0), // testStruct2.f1 (id = 2) is ref to struct
+				meta_ref, c2b0(0), // testStruct2.f2 (id = 5) is ref to struct
+				typeId(nil), meta_nil, // testStruct2.f3
+			},
+			nil,
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_PointerChain(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			func() any {
+				var x1, x2 any
+				y := byte(111)
+				x1 = &x2
+				x2 = &y
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId((*any)(nil)), meta_nonil, // x1
+				typeId((*byte)(nil)), meta_nonil, 111, // x2
+			},
+			nil,
+		},
+		// #2
+		{
+			func() any {
+				var x1, x2, x3 any
+				y := byte(111)
+				x1 = &x2
+				x2 = &x3
+				x3 = &y
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId((*any)(nil)), meta_nonil, // x1
+				typeId((*any)(nil)), meta_nonil, // x2
+				typeId((*byte)(nil)), meta_nonil, 111, // x3
+			},
+			nil,
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_CyclicPointerChain(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			func() any {
+				var x any
+				x = &x
+				return x
+			}(),
+			[]byte{version, typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0)},
+			func(_, actual any) bool {
+				v := actual.(*any)
+				return v == *v
+			},
+		},
+		// #2
+		{
+			func() any {
+				var x1, x2 any
+				x1 = &x2
+				x2 = &x1
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId((*any)(nil)), meta_nonil, // x1
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0), // x2
+			},
+			func(_, actual any) bool {
+				x1 := actual.(*any)
+				x2 := (*x1).(*any)
+				return *x2 == x1 && x2 != x1
+			},
+		},
+		// #3
+		{
+			func() any {
+				var x1, x2, x3 any
+				x1 = &x2
+				x2 = &x3
+				x3 = &x1
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId((*any)(nil)), meta_nonil, // x1
+				typeId((*any)(nil)), meta_nonil, // x2
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(0), // x3
+			},
+			func(_, actual any) bool {
+				x1 := actual.(*any)
+				x2 := (*x1).(*any)
+				x3 := (*x2).(*any)
+				return *x3 == x1 && x1 != x2 && x2 != x3
+			},
+		},
+		// #4
+		{
+			func() any {
+				var x testRecPtr
+				x = &x
+				return x
+			}(),
+			[]byte{version, typeId(testRecPtr(nil)), meta_nonil, meta_ref, c2b0(0)},
+			func(_, actual any) bool {
+				v := actual.(testRecPtr)
+				return v == *v
+			},
+		},
+		// #5
+		{
+			func() any {
+				var x1, x2 testRecPtr
+				x1 = &x2
+				x2 = &x1
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId(testRecPtr(nil)), meta_nonil, // x1
+				meta_nonil, meta_ref, c2b0(0), // x2
+			},
+			func(_, actual any) bool {
+				x1 := actual.(testRecPtr)
+				x2 := *x1
+				return *x2 == x1 && x2 != x1
+			},
+		},
+		// #6
+		{
+			func() any {
+				var x1, x2, x3 testRecPtr
+				x1 = &x2
+				x2 = &x3
+				x3 = &x1
+				return x1
+			}(),
+			[]byte{
+				version,
+				typeId(testRecPtr(nil)), meta_nonil, // x1
+				meta_nonil,                    // x2
+				meta_nonil, meta_ref, c2b0(0), // x3
+			},
+			func(_, actual any) bool {
+				x1 := actual.(testRecPtr)
+				x2 := *x1
+				x3 := *x2
+				return *x3 == x1 && x1 != x2 && x2 != x3
+			},
+		},
+		// #7
+		{
+			func() any {
+				var x1 any
+				var x2 *any
+				var x3 **any
+				x2 = &x1
+				x3 = &x2
+				x1 = x3
+				return x3
+			}(),
+			[]byte{
+				version,
+				typeId((**any)(nil)), meta_nonil, // x3
+				meta_nonil,        // x2
+				meta_ref, c2b0(0), // x1 == x3
+			},
+			func(_, actual any) bool {
+				x3 := actual.(**any)
+				x2 := *x3
+				x1 := *x2
+				return x1 == x3
+			},
+		},
+		// #8
+		{
+			func() any {
+				var x1 any
+				var x2 *any
+				var x3 **any
+				x2 = &x1
+				x3 = &x2
+				x1 = &x3
+				return x3
+			}(),
+			[]byte{
+				version,
+				typeId((**any)(nil)), meta_nonil, // x3
+				meta_nonil,                                           // x2
+				typeId((***any)(nil)), meta_nonil, meta_ref, c2b0(0), // x1 == x3
+			},
+			func(_, actual any) bool {
+				x3 := actual.(**any)
+				x2 := *x3
+				x1 := *x2
+				return *x1.(***any) == x3
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_BackwardPointerToContainer(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			func() any {
+				s := &testStruct2{
+					f1: true,
+				}
+				s.f2 = &s.f1
+				s.f3 = &s.f1
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId(false), meta_tru, // f1 (id = 3)
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
+				meta_ref, c2b0(7), // f3 is *f1
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f1 = false
+				return *s.f2.(*any) == false && *s.f3.(*any) == false
+			},
+		},
+		// #2
+		{
+			func() any {
+				b := true
+				s := &testStruct3{
+					f1: &b,
+				}
+				s.f2 = &s.f1
+				s.f3 = &s.f1
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct3)(nil)), meta_nonil, meta_cntr, // *testStruct3
+				meta_nonil, meta_tru, // f1 (id = 3)
+				typeId((**bool)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
+				meta_ref, c2b0(7), // f3 is *f1
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct3)
+				s.f1 = nil
+				return *s.f2.(**bool) == nil && *s.f3.(**bool) == nil
+			},
+		},
+		// #3
+		{
+			func() any {
+				var x any = true
+				s := &testStruct4{
+					f1: &x,
+				}
+				s.f2 = &s.f1
+				s.f3 = &s.f1
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct4)(nil)), meta_nonil, meta_cntr, // *testStruct4
+				meta_nonil, typeId(false), meta_tru, // f1 (id = 3)
+				typeId((**any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 6)
+				meta_ref, c2b0(8), // f3 is *f1
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct4)
+				*s.f1 = byte(123)
+				return **s.f2.(**any) == *s.f1 && **s.f3.(**any) == *s.f1
+			},
+		},
+		// #4
+		{
+			func() any {
+				s := &testStruct2{}
+				s.f1 = s
+				s.f2 = &s.f1
+				s.f3 = &s.f1
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				meta_ref, c2b0(0), // f1 is ref to s (id = 3)
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f2 is *f1 (id = 5)
+				meta_ref, c2b0(6), // f3 is ref to f2 value
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f1 = byte(123)
+				return *s.f2.(*any) == s.f1 && *s.f3.(*any) == s.f1
+			},
+		},
+		// #5
+		{
+			func() any {
+				s := &testStruct2{}
+				s.f1 = &s.f1
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(2), // f1 is ref to f1 (id = 3)
+				typeId(nil), meta_nil, // f2
+				typeId(nil), meta_nil, // f3
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				return *s.f1.(*any) == s.f1 && s.f1 != s
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_ForwardPointerToContainer(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			func() any {
+				s := &testStruct2{}
+				x := &s.f3
+				s.f1 = &x
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(9), // f1 is ref to f3 (id = 2)
+				typeId(nil), meta_nil, // f2 (id = 7)
+				typeId(nil), meta_nil, // f3 (id = 9)
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f3 = byte(123)
+				return **s.f1.(**any) == s.f3 && s.f3 == byte(123)
+			},
+		},
+		// #2
+		{
+			func() any {
+				s := &testStruct2{}
+				x := &s.f3
+				s.f1 = &x
+				s.f2 = &x
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(8), // f1 is ref to f3 (id = 2)
+				meta_ref, c2b0(4), // f2 (id = 6)
+				typeId(nil), meta_nil, // f3 (id = 8)
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f3 = byte(123)
+				return **s.f1.(**any) == s.f3 && **s.f2.(**any) == s.f3 && s.f3 == byte(123)
+			},
+		},
+		// #3
+		{
+			func() any {
+				s := &testStruct2{}
+				x := &s.f2
+				s.f1 = &x
+				s.f3 = &x
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((**any)(nil)), meta_nonil, meta_nonil, meta_ref, c2b0(6), // f1 is ref to f2 (id = 2)
+				typeId(nil), meta_nil, // f2 (id = 6)
+				meta_ref, c2b0(4), // f3 (id = 8)
+
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f2 = byte(123)
+				return **s.f1.(**any) == s.f2 && **s.f3.(**any) == s.f2 && s.f2 == byte(123)
+			},
+		},
+		// #4
+		{
+			func() any {
+				s := &testStruct2{}
+				s.f1 = &s.f3
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(8), // f1 is ref to f3 (id = 2)
+				typeId(nil), meta_nil, // f2 (id = 5)
+				typeId(nil), meta_nil, // f3 (id = 8)
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f3 = byte(123)
+				return *s.f1.(*any) == s.f3 && s.f3 == byte(123)
+			},
+		},
+		// #5
+		{
+			func() any {
+				s := &testStruct2{}
+				s.f1 = &s.f3
+				s.f2 = &s.f3
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(7), // f1 is ref to f3 (id = 2)
+				meta_ref, c2b0(4), // f2 (id = 5)
+				typeId(nil), meta_nil, // f3 (id = 7)
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f3 = byte(123)
+				return *s.f1.(*any) == s.f3 && *s.f2.(*any) == s.f3 && s.f3 == byte(123)
+			},
+		},
+		// #6
+		{
+			func() any {
+				s := &testStruct2{}
+				s.f1 = &s.f2
+				s.f3 = &s.f2
+				return s
+			}(),
+			[]byte{
+				version, typeId((*testStruct2)(nil)), meta_nonil, meta_cntr, // *testStruct2
+				typeId((*any)(nil)), meta_nonil, meta_ref, c2b0(5), // f1 is ref to f2 (id = 2)
+				typeId(nil), meta_nil, // f2 (id = 5)
+				meta_ref, c2b0(4), // f3 (id = 7)
+
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				s.f2 = byte(123)
+				return *s.f1.(*any) == s.f2 && *s.f3.(*any) == s.f2 && s.f2 == byte(123)
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_ComplexValue(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			newLst(),
+			[]byte{
+				version, typeId((*lst)(nil)), meta_nonil, meta_cntr, // *lst
+				meta_cntr,                                           // lst.root header
+				meta_nonil, meta_ref, c2b0(2),                       // lst.root.next = &lst.root (id = 4)
+				meta_ref, c2b0(5),                                   // lst.root.prev = &lst.root
+				meta_nil,                                            // lst.root.lst = nil
+			},
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*lst)
+				root := s.root
+				s.root = testNode{}
+				return root.next == root.prev && root.next == &s.root
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_Serializable(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			testSerializable(0x1234),
+			[]byte{version, typeId(testSerializable(0)), c2b0(2), 0x12, 0x34},
+			nil,
+		},
+		// #2
+		{
+			[]any{testSerializable(1), nil},
+			[]byte{
+				version,
+				typeId([]any{}), meta_nonil, c2b0(2), c2b0(2),
+				typeId(testSerializable(0)), c2b0(2), 0, 1,
+				typeId(nil), meta_nil,
+			},
+			nil,
+		},
+		// #3
+		{
+			testPtrSerializable{"a", []string{"b"}},
+			nil,
+			nil,
+		},
+		// #4
+		{
+			&testPtrSerializable{"a", nil},
+			nil,
+			nil,
+		},
+		// #5
+		{
+			func() any {
+				s := &testStruct2{}
+				v := testSerializable(2)
+				s.f1 = &v
+				s.f2 = &v
+				s.f3 = v
+				return s
+			}(),
+			nil,
 			func(expected, actual any) bool {
 				if !defaultEq(expected, actual) {
 					return false
 				}
 				s := actual.(*testStruct2)
-				s.f2 = byte(123)
-				return *s.f1.(*any) == s.f2 && *s.f3.(*any) == s.f2 && s.f2 == byte(123)
+				return s.f1.(*testSerializable) == s.f2.(*testSerializable)
+			},
+		},
+		// #6
+		{
+			func() any {
+				s := &testStruct4{}
+				s.f2 = &testPtrSerializable{"a", []string{"b", "c"}}
+				s.f1 = &s.f3
+				s.f3 = testPtrSerializable{"d", nil}
+				return s
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct4)
+				return s.f1 == &s.f3
+			},
+		},
+	}
+	runTests(items, reg, t)
+}
+
+func Test_Marshalers(t *testing.T) {
+	reg, typeId := registry()
+	items := []testItem{
+		// #1
+		{
+			testBinaryMarshaler{1, "a"},
+			[]byte{version, typeId(testBinaryMarshaler{}), c2b0(2), 1, 'a'},
+			nil,
+		},
+		// #2
+		{
+			testGobEncoder{2},
+			[]byte{version, typeId(testGobEncoder{}), c2b0(1), 2},
+			nil,
+		},
+		// #3
+		{
+			func() any {
+				s := &testStruct2{}
+				v := testBinaryMarshaler{3, "b"}
+				s.f1 = &v
+				s.f2 = &v
+				s.f3 = testGobEncoder{4}
+				return s
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				return s.f1.(*testBinaryMarshaler) == s.f2.(*testBinaryMarshaler)
+			},
+		},
+		// #4
+		{
+			[]any{time.Date(2024, 2, 29, 10, 20, 30, 40, time.UTC), url.URL{Scheme: "https", Host: "example.com", Path: "/a"}},
+			nil,
+			nil,
+		},
+		// #5
+		{
+			big.NewInt(-1234567890),
+			nil,
+			func(expected, actual any) bool {
+				return expected.(*big.Int).Cmp(actual.(*big.Int)) == 0
+			},
+		},
+		// #6
+		{
+			testEmbeddedMarshaler{testBinaryMarshaler{5, "c"}, "d"},
+			nil,
+			nil,
+		},
+		// #7
+		{
+			testEmbeddedTime{time.Date(2024, 2, 29, 10, 20, 30, 40, time.UTC), "e"},
+			nil,
+			nil,
+		},
+	}
+	runTests(items, reg, t)
+	for _, v := range []any{testEmbeddedMarshaler{}, testEmbeddedTime{}} {
+		if m := marshalerOf(reflect.TypeOf(v)); m != noMarshaler {
+			t.Errorf("%T must be encoded field by field, but its marshaler is %d", v, m)
+		}
+	}
+
+	if _, err := TrySerialize(testBinaryMarshaler{}, reg); err == nil || !strings.Contains(err.Error(), "empty name") {
+		t.Errorf("TrySerialize(testBinaryMarshaler{}) must return error of MarshalBinary, but actual error is %v", err)
+	}
+	data := []byte{version, typeId(testGobEncoder{}), c2b0(2), 1, 2}
+	if _, err := Unserialize(data, reg); err == nil || !strings.Contains(err.Error(), "invalid data length 2") {
+		t.Errorf("Unserialize(%v) must return error of GobDecode, but actual error is %v", data, err)
+	}
+}
+
+func Test_CodecMarshaler(t *testing.T) {
+	reg, _ := registry()
+	items := []testItem{
+		// #1
+		{
+			testCodecMarshaler{name: "a", items: []int{1, 2}},
+			nil,
+			nil,
+		},
+		// #2
+		{
+			func() any {
+				x := 1
+				root := &testCodecMarshaler{name: "a", shared: &x}
+				child := &testCodecMarshaler{name: "b", items: []int{3}, parent: root, shared: &x}
+				return &testStruct2{f1: root, f2: &x, f3: child}
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				root, child := s.f1.(*testCodecMarshaler), s.f3.(*testCodecMarshaler)
+				return child.parent == root && root.shared == s.f2.(*int) && child.shared == s.f2.(*int)
+			},
+		},
+		// #3: values written by MarshalCodec point to values placed later in data
+		{
+			func() any {
+				h := &testCodecHolder{m: testCodecMarshaler{name: "a"}, n: 1}
+				h.m.shared = &h.n
+				h.p = &testCodecHolder{m: testCodecMarshaler{name: "b", shared: &h.n}}
+				h.p.m.parent = &h.p.m
+				return h
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				h := actual.(*testCodecHolder)
+				return h.m.shared == &h.n && h.p.m.shared == &h.n && h.p.m.parent == &h.p.m && h.n == 1
+			},
+		},
+	}
+	runTests(items, reg, t)
+
+	if _, err := TrySerialize(testCodecMarshaler{}, reg); err == nil || !strings.Contains(err.Error(), "empty name") {
+		t.Errorf("TrySerialize(testCodecMarshaler{}) must return error of MarshalCodec, but actual error is %v", err)
+	}
+	data := Serialize(testStruct2{f1: testCodecMarshaler{name: "a"}}, reg)
+	data = bytes.Replace(data, Serialize("a", reg)[1:], Serialize(1, reg)[1:], 1)
+	if _, err := Unserialize(data, reg); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Unserialize(%v) must return error %q, but actual error is %v", data, ErrTypeMismatch, err)
+	}
+}
+
+func Test_Codecs(t *testing.T) {
+	reg, typeId := registry()
+	reg.RegisterCodec(
+		reflect.TypeOf(testStruct6{}),
+		func(v any) ([]byte, error) {
+			s := v.(testStruct6)
+			if s.f5 != "" {
+				return nil, fmt.Errorf("f5 is not supported")
+			}
+			return []byte{byte(s.f1), s.F4}, nil
+		},
+		func(data []byte) (any, error) {
+			if len(data) != 2 {
+				return nil, fmt.Errorf("invalid data length %d", len(data))
+			}
+			return &testStruct6{f1: int(data[0]), F4: data[1]}, nil
+		},
+	)
+	RegisterCodecOf(reg,
+		func(v testSerializable) ([]byte, error) {
+			return []byte{byte(v)}, nil
+		},
+		func(data []byte) (testSerializable, error) {
+			return testSerializable(data[0]), nil
+		},
+	)
+	items := []testItem{
+		// #1
+		{
+			testStruct6{f1: 1, F4: 2},
+			[]byte{version, typeId(testStruct6{}), c2b0(2), 1, 2},
+			nil,
+		},
+		// #2: codec takes precedence over Serializable
+		{
+			testSerializable(3),
+			[]byte{version, typeId(testSerializable(0)), c2b0(1), 3},
+			nil,
+		},
+		// #3
+		{
+			func() any {
+				s := &testStruct2{}
+				v := testStruct6{f1: 4}
+				s.f1 = &v
+				s.f2 = &v
+				s.f3 = []testStruct6{{F4: 5}}
+				return s
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				if !defaultEq(expected, actual) {
+					return false
+				}
+				s := actual.(*testStruct2)
+				return s.f1.(*testStruct6) == s.f2.(*testStruct6)
+			},
+		},
+	}
+	runTests(items, reg, t)
+
+	if _, err := TrySerialize(testStruct6{f5: "a"}, reg); err == nil || !strings.Contains(err.Error(), "f5 is not supported") {
+		t.Errorf("TrySerialize(testStruct6{}) must return error of the codec, but actual error is %v", err)
+	}
+	data := []byte{version, typeId(testStruct6{}), c2b0(1), 1}
+	if _, err := Unserialize(data, reg); err == nil || !strings.Contains(err.Error(), "invalid data length 1") {
+		t.Errorf("Unserialize(%v) must return error of the codec, but actual error is %v", data, err)
+	}
+
+	other, _ := registry()
+	value := testStruct6{f1: 1, f5: "a"}
+	if actual, err := Unserialize(Serialize(value, other), other); err != nil || actual != value {
+		t.Errorf("codecs must not be shared by registries, but Unserialize returns %v, %v", actual, err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("RegisterCodec(any) must panic")
+			}
+		}()
+		reg.RegisterCodec(reflect.TypeOf((*any)(nil)).Elem(), func(any) ([]byte, error) { return nil, nil }, func([]byte) (any, error) { return nil, nil })
+	}()
+}
+
+func Test_StdlibTypes(t *testing.T) {
+	reg := NewTypeRegistry(false)
+	reg.RegisterBaseTypes()
+	reg.RegisterStdlibTypes()
+	reg.RegisterTypeOf([]any{})
+	reg.RegisterTypeOf([]*time.Location{})
+	sameTime := func(expected, actual any) bool {
+		e, a := expected.(time.Time), actual.(time.Time)
+		en, eo := e.Zone()
+		an, ao := a.Zone()
+		return e.Equal(a) && en == an && eo == ao && e.Location().String() == a.Location().String()
+	}
+	instant := time.Date(2024, 2, 29, 10, 20, 30, 40, time.UTC)
+	items := []testItem{
+		// #1
+		{time.Time{}, nil, nil},
+		// #2
+		{instant, nil, nil},
+		// #3
+		{instant.In(time.FixedZone("MSK", 3*3600)), nil, sameTime},
+		// #4
+		{instant.In(time.FixedZone("", -5400)), nil, sameTime},
+		// #5
+		{time.Duration(-90 * time.Second), nil, nil},
+		// #6
+		{
+			[]*time.Location{time.UTC, time.Local, time.UTC, nil},
+			nil,
+			func(expected, actual any) bool {
+				locs := actual.([]*time.Location)
+				return locs[0] == time.UTC && locs[1] == time.Local && locs[2] == time.UTC && locs[3] == nil
+			},
+		},
+	}
+	if loc, err := time.LoadLocation("Europe/Moscow"); err == nil {
+		items = append(items, testItem{instant.In(loc), nil, sameTime})
+	}
+	runTests(items, reg, t)
+
+	if data := Serialize(instant, reg); len(data) > 16 {
+		t.Errorf("encoded time must not exceed 16 bytes, but actual data is %v", data)
+	}
+	data := Serialize(instant.In(time.FixedZone("Unknown/Zone", 3600)), reg)
+	if actual, err := UnserializeAs[time.Time](data, reg); err != nil || !sameTime(instant.In(time.FixedZone("Unknown/Zone", 3600)), actual) {
+		t.Errorf("Unserialize(%v) returns %v, %v", data, actual, err)
+	}
+	data = Serialize(instant, reg)
+	data = data[:len(data)-5]
+	data[2] -= 5
+	if _, err := Unserialize(data, reg); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("Unserialize(%v) must return error %q, but actual error is %v", data, ErrUnexpectedEOF, err)
+	}
+}
+
+func Test_BigNumbers(t *testing.T) {
+	reg := NewTypeRegistry(false)
+	reg.RegisterBaseTypes()
+	reg.RegisterStdlibTypes()
+	reg.RegisterTypeOf([]any{})
+	reg.RegisterTypeOf([]*big.Int{})
+	typeId := func(v any) byte {
+		return u2bs(uint64(reg.typeIdByValue(reflect.ValueOf(v))), 3)[0]
+	}
+	sameFloat := func(expected, actual any) bool {
+		e, a := expected.(big.Float), actual.(big.Float)
+		return e.Cmp(&a) == 0 && e.Signbit() == a.Signbit() && e.Prec() == a.Prec() && e.Mode() == a.Mode() && e.Acc() == a.Acc()
+	}
+	quo := func(x, y float64, prec uint, mode big.RoundingMode) big.Float {
+		z := new(big.Float).SetPrec(prec).SetMode(mode)
+		return *z.Quo(big.NewFloat(x), big.NewFloat(y))
+	}
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890123456789", 10)
+	items := []testItem{
+		// #1
+		{*big.NewInt(0), nil, nil},
+		// #2
+		{*big.NewInt(1000), []byte{version, typeId(big.Int{}), c2b0(3), 0, 0x03, 0xE8}, nil},
+		// #3
+		{*huge, nil, nil},
+		// #4
+		{*big.NewRat(0, 1), nil, nil},
+		// #5
+		{*big.NewRat(-3, 7), nil, nil},
+		// #6
+		{*new(big.Rat).SetFrac(huge, big.NewInt(11)), nil, nil},
+		// #7
+		{big.Float{}, nil, sameFloat},
+		// #8
+		{*big.NewFloat(-1.5), nil, sameFloat},
+		// #9
+		{*new(big.Float).SetPrec(10).Neg(new(big.Float)), nil, sameFloat},
+		// #10
+		{*new(big.Float).SetInf(true), nil, sameFloat},
+		// #11
+		{quo(1, 3, 200, big.ToZero), nil, sameFloat},
+		// #12
+		{quo(-2, 3, 10, big.AwayFromZero), nil, sameFloat},
+		// #13
+		{quo(1, 3, 100, big.ToPositiveInf), nil, sameFloat},
+		// #14
+		{quo(-1, 3, 53, big.ToNearestAway), nil, sameFloat},
+		// #15: rounded to a power of 2
+		{*new(big.Float).SetPrec(4).SetFloat64(1 - 1.0/1024), nil, sameFloat},
+		// #16
+		{
+			func() any {
+				x := big.NewInt(-1)
+				return []*big.Int{x, x}
+			}(),
+			nil,
+			func(expected, actual any) bool {
+				values := actual.([]*big.Int)
+				return defaultEq(expected, actual) && values[0] == values[1]
 			},
 		},
 	}
-	runTests(items, reg, t)
+	runTests(items, reg, t)
+
+	data := Serialize(*big.NewFloat(1), reg)
+	data[3] |= 0b111 // invalid rounding mode
+	if _, err := Unserialize(data, reg); err == nil || !strings.Contains(err.Error(), "invalid header") {
+		t.Errorf("Unserialize(%v) must return error of invalid header, but actual error is %v", data, err)
+	}
+	data = Serialize(*big.NewRat(1, 2), reg)
+	data[len(data)-1] = 0 // zero denominator
+	if _, err := Unserialize(data, reg); err == nil || !strings.Contains(err.Error(), "zero denominator") {
+		t.Errorf("Unserialize(%v) must return error of zero denominator, but actual error is %v", data, err)
+	}
+}
+
+func Test_DecodeErrors(t *testing.T) {
+	reg, typeId := registry()
+	unserializer := NewUnserializer().WithTypeRegistry(reg)
+	items := []struct {
+		data []byte
+		err  error
+		pos  int
+		id   int
+		path string
+	}{
+		// #1: empty data
+		{
+			[]byte{},
+			ErrUnexpectedEOF, 0, -1, "",
+		},
+		// #2: unknown type
+		{
+			append([]byte{version}, u2bs(1000, 3)...),
+			ErrUnknownTypeId, 3, -1, "",
+		},
+		// #3: truncated string
+		{
+			[]byte{version, typeId(""), c2b0(3), 'a'},
+			ErrUnexpectedEOF, 3, 0, "string",
+		},
+		// #4: truncated slice
+		{
+			[]byte{version, typeId([]int{}), meta_nonil, c2b0(2), c2b0(2), 0b0001_0000 | 2},
+			ErrUnexpectedEOF, 6, 3, "[]int > int",
+		},
+		// #5: reference to unknown node
+		{
+			[]byte{version, typeId([]any{}), meta_nonil, c2b0(1), c2b0(1), meta_ref, c2b0(7)},
+			ErrBadReference, 7, 1, "[]interface {} > interface {}",
+		},
+		// #6: reference to value of another type
+		{
+			[]byte{version, typeId([]string{}), meta_nonil, c2b0(2), c2b0(2), c2b0(1), 'a', meta_ref, c2b0(0)},
+			ErrTypeMismatch, 9, 3, "[]string > string",
+		},
+		// #7: pointer to value of another type
+		{
+			[]byte{version, typeId([]any{}), meta_nonil, c2b0(2), c2b0(2), typeId(""), c2b0(0), typeId((*int)(nil)), meta_nonil, meta_ref, c2b0(2)},
+			ErrTypeMismatch, 11, 6, "[]interface {} > interface {} > *int",
+		},
+		// #8: unsupported version
+		{
+			[]byte{0, typeId(""), c2b0(0)},
+			ErrVersionMismatch, 1, -1, "",
+		},
+		// #9: truncated struct
+		{
+			[]byte{version, typeId(testStruct6{}), meta_cntr, 0b0001_0000 | 2},
+			ErrUnexpectedEOF, 4, 3, "codec.testStruct6 > bool",
+		},
+	}
+	for i, item := range items {
+		value, err := unserializer.Decode(item.data)
+		var decodeErr *DecodeError
+		if err == nil {
+			t.Errorf("Test #%d: Decode(%v) must return error, but actual value is %v", i+1, item.data, value)
+		} else if !errors.Is(err, item.err) || !errors.As(err, &decodeErr) {
+			t.Errorf("Test #%d: Decode(%v) must return %q, but actual error is %q", i+1, item.data, item.err, err)
+		} else if decodeErr.Offset != item.pos || decodeErr.NodeId != item.id || decodeErr.Path != item.path {
+			t.Errorf("Test #%d: Decode(%v) returns error with wrong position: %q", i+1, item.data, err)
+		}
+	}
+	data := Serialize(newLst(), reg)
+	for i := 1; i < len(data); i++ {
+		if value, err := unserializer.Decode(data[:i]); !errors.Is(err, ErrUnexpectedEOF) {
+			t.Errorf("Decode(%v) must return %q, but actual value is %v (err: %v)", data[:i], ErrUnexpectedEOF, value, err)
+		}
+	}
 }
 
-func Test_ComplexValue(t *testing.T) {
+func Test_DecodeLimits(t *testing.T) {
 	reg, typeId := registry()
-	items := []testItem{
+	items := []struct {
+		data   []byte
+		limits Limits
+	}{
 		// #1
 		{
-			newLst(),
-			[]byte{
-				version, typeId((*lst)(nil)), meta_nonil, meta_cntr, // *lst
-				meta_cntr,                                           // lst.root header
-				meta_nonil, meta_ref, c2b0(2),                       // lst.root.next = &lst.root (id = 4)
-				meta_ref, c2b0(5),                                   // lst.root.prev = &lst.root
-				meta_nil,                                            // lst.root.lst = nil
-			},
-			func(expected, actual any) bool {
-				if !defaultEq(expected, actual) {
-					return false
-				}
-				s := actual.(*lst)
-				root := s.root
-				s.root = testNode{}
-				return root.next == root.prev && root.next == &s.root
-			},
+			[]byte{version, typeId(""), c2b0(3), 'a', 'b', 'c'},
+			Limits{MaxBytes: 5},
+		},
+		// #2
+		{
+			[]byte{version, typeId(""), c2b0(3), 'a', 'b', 'c'},
+			Limits{MaxLength: 2},
+		},
+		// #3
+		{
+			append([]byte{version, typeId([]byte{}), meta_nonil, c2b0(0)}, u2bs(1<<40, 4)...),
+			Limits{MaxLength: 1 << 20},
+		},
+		// #4
+		{
+			append([]byte{version, typeId(make(chan int)), meta_nonil}, u2bs(1<<40, 4)...),
+			Limits{MaxChanCapacity: 1 << 10},
+		},
+		// #5
+		{
+			[]byte{version, typeId([]any{}), meta_nonil, c2b0(1), c2b0(1), typeId([]any{}), meta_nonil, c2b0(0), c2b0(0)},
+			Limits{MaxDepth: 2},
+		},
+		// #6
+		{
+			[]byte{version, typeId([]int{}), meta_nonil, c2b0(3), c2b0(3), 0b0001_0000, 0b0001_0000, 0b0001_0000},
+			Limits{MaxNodes: 5},
+		},
+		// #7
+		{
+			append([]byte{version, typeId("")}, u2bs(math.MaxUint64, 4)...),
+			Limits{},
 		},
 	}
-	runTests(items, reg, t)
+	for i, item := range items {
+		unserializer := NewUnserializer().WithOptions([]any{reg, item.limits})
+		if value, err := unserializer.Decode(item.data); !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("Test #%d: Decode(%v) must return %q, but actual value is %v (err: %v)", i+1, item.data, ErrLimitExceeded, value, err)
+		}
+	}
+	limits := Limits{MaxBytes: 6, MaxLength: 3, MaxChanCapacity: 1, MaxDepth: 2, MaxNodes: 1}
+	if value, err := Unserialize([]byte{version, typeId(""), c2b0(3), 'a', 'b', 'c'}, reg, limits); err != nil || value != "abc" {
+		t.Errorf("Unserialize() returns wrong value %v (err: %v)", value, err)
+	}
+}
+
+func Test_DecodeDefaultLimits(t *testing.T) {
+	reg, typeId := registry()
+	// capacity of the slice is not backed by data, so it is restored only within the spare memory
+	data := append([]byte{version, typeId([]int64{}), meta_nonil, c2b0(1)}, u2bs(1<<23, 4)...)
+	data = append(data, c2b0(7))
+	if value, err := Unserialize(data, reg); err != nil || !reflect.DeepEqual(value, []int64{-4}) || cap(value.([]int64)) > spareMemory/8+1 {
+		t.Errorf("Unserialize(%v) returns wrong value %v (err: %v)", data, value, err)
+	}
+	// length of the slice is backed by data
+	data = append([]byte{version, typeId([]int64{}), meta_nonil}, u2bs(1<<20, 4)...)
+	data = append(data, u2bs(1<<20, 4)...)
+	if value, err := Unserialize(data, reg); !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("Unserialize(%v) must return %q, but actual value is %v (err: %v)", data, ErrUnexpectedEOF, value, err)
+	}
+	data = append([]byte{version, typeId(make(chan [1024]byte)), meta_nonil}, u2bs(1<<16, 4)...)
+	if value, err := Unserialize(data, reg); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Unserialize(%v) must return %q, but actual value is %v (err: %v)", data, ErrLimitExceeded, value, err)
+	}
+	// depth is not limited by default, so long lists encoded by Serialize are decoded
+	list := &testNode{}
+	for i := 0; i < 20000; i++ {
+		list = &testNode{next: list}
+	}
+	data = Serialize(list, reg)
+	value, err := Unserialize(data, reg)
+	if err != nil {
+		t.Fatalf("Unserialize() of long list raises error: %v", err)
+	}
+	length := 0
+	for node := value.(*testNode); node != nil; node = node.next {
+		length++
+	}
+	if length != 20001 {
+		t.Errorf("Unserialize() of long list returns %d nodes instead of 20001", length)
+	}
+	var decodeErr *DecodeError
+	if value, err := Unserialize(data, reg, Limits{MaxDepth: 10000}); !errors.As(err, &decodeErr) || !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Unserialize() of too deep value must return %q, but actual value is %v (err: %v)", ErrLimitExceeded, value, err)
+	} else if value != nil || strings.Count(decodeErr.Path, ">") != 2*maxPathTypes || !strings.Contains(decodeErr.Path, "types)") {
+		t.Errorf("Unserialize() of too deep value returns %v and error with too long path: %v", value, err)
+	}
+}
+
+func Test_InvalidOptions(t *testing.T) {
+	if value, err := Unserialize(Serialize(1), 1.5); err == nil {
+		t.Errorf("Unserialize() with invalid option must return error, but actual value is %v", value)
+	}
+	if value, err := UnserializeAs[int](Serialize(1), Limits{}, "option"); err == nil {
+		t.Errorf("UnserializeAs() with invalid option must return error, but actual value is %v", value)
+	}
+	if data, err := TrySerialize(1, Limits{}, "option"); err == nil {
+		t.Errorf("TrySerialize() with invalid option must return error, but actual value is %v", data)
+	}
+	options := []any{TypeIdModeName, Limits{MaxBytes: 100}}
+	data, err := TrySerialize(1, options...)
+	if err != nil {
+		t.Fatalf("TrySerialize() must ignore decoding options, but returns error: %v", err)
+	}
+	if value, err := Unserialize(data, options...); err != nil || value != 1 {
+		t.Errorf("Unserialize() must ignore encoding options, but returns %v (err: %v)", value, err)
+	}
+}
+
+func Test_TryEncode(t *testing.T) {
+	reg := NewTypeRegistry(false)
+	reg.RegisterBaseTypes()
+	serializer := NewSerializer().WithTypeRegistry(reg)
+	if data, err := serializer.TryEncode(testStruct6{}); err == nil {
+		t.Errorf("TryEncode(%T) must return error, but actual value is %v", testStruct6{}, data)
+	}
+	reg.RegisterTypeOf(testStruct6{})
+	expected := testStruct6{f1: 1, F3: "a"}
+	data, err := TrySerialize(expected, reg)
+	if err != nil {
+		t.Fatalf("TrySerialize(%T) raises error: %q", expected, err)
+	}
+	if actual, err := Unserialize(data, reg); err != nil || !defaultEq(expected, actual) {
+		t.Errorf("Unserialize(%v) returns wrong value %v (err: %v)", data, actual, err)
+	}
 }
 
 /*func TestPtr(t *testing.T) {
@@ -1874,3 +3192,579 @@ func Test_ComplexValue(t *testing.T) {
 	v := v1.Interface()
 	fmt.Println(v)
 }*/
+
+func Test_DecodeV1(t *testing.T) {
+	reg := NewTypeRegistry(false)
+	reg.RegisterBaseTypes()
+	reg.RegisterTypeOf([]any{})       // id 19 in version 1
+	reg.RegisterTypeOf(testStruct6{}) // id 20 in version 1
+	samePtrs := func(expected, actual any) bool {
+		a := actual.([]any)
+		return a[0].(*int) == a[1].(*int) && *a[0].(*int) == 7
+	}
+	structItem := testItem{
+		testStruct6{f1: 1, f2: true, F3: "x", F4: 7},
+		[]byte{version1, tType, 20, tStruct, 5, tInt | signed, 2, tBool | tru, tString, 1, 'x', tInt8, 7, tString, 0},
+		nil,
+	}
+	var items = []testItem{
+		{nil, []byte{version1, tNil}, nil},
+		{true, []byte{version1, tBool | tru}, nil},
+		{"ab", []byte{version1, tString, 2, 'a', 'b'}, nil},
+		{-3, []byte{version1, tInt | signed, 5}, nil},
+		{uint16(300), []byte{version1, tInt16, 0x01, 0x2C}, nil},
+		{int64(5), []byte{version1, tInt64 | signed | meta, 0b001_01010}, nil},
+		{1.5, []byte{version1, tFloat | wide | 1, 0xF8, 0x3F}, nil},
+		{[]any{true, "a"}, []byte{version1, tType, 19, tList, 2, tInterface, tBool | tru, tInterface, tString, 1, 'a'}, nil},
+		structItem,
+		{
+			nil,
+			[]byte{version1, tType, 19, tList, 2, tInterface, tPointer, tInt | signed, 14, tInterface, tRef, 2},
+			samePtrs,
+		},
+	}
+	unserializer := NewUnserializer().WithTypeRegistry(reg)
+	for i, item := range items {
+		actual, err := unserializer.Decode(item.data)
+		if err != nil {
+			t.Errorf("Test #%d: Decode(%v) raises error: %q", i+1, item.data, err)
+		} else if res, err := equal(item.eq, item.value, actual); res == false {
+			t.Errorf("Test #%d: Decode(%v) returns wrong value %#v (check err: %v)", i+1, item.data, actual, err)
+		}
+	}
+
+	data := []byte{version1, tType, 20, tStruct, 2, tString, 2, 'F', '3', tString, 1, 'x', tString, 2, 'f', '1', tInt | signed, 2}
+	actual, err := Unserialize(data, reg, StructCodingModeName)
+	if expected := (testStruct6{f1: 1, F3: "x"}); err != nil || !defaultEq(expected, actual) {
+		t.Errorf("Unserialize(%v) in name mode returns wrong value %#v (err: %v)", data, actual, err)
+	}
+
+	data, err = Migrate(structItem.data, reg)
+	if err != nil {
+		t.Fatalf("Migrate(%v) raises error: %q", structItem.data, err)
+	}
+	if data[0] != version {
+		t.Errorf("Migrate(%v) must return data of version %d, but actual version is %d", structItem.data, version, data[0])
+	}
+	if actual, err := Unserialize(data, reg); err != nil || !defaultEq(structItem.value, actual) {
+		t.Errorf("Unserialize(%v) returns wrong value %#v (err: %v)", data, actual, err)
+	}
+	data, err = Migrate(structItem.data, reg, TypeIdModeName, Limits{MaxBytes: 100})
+	if err != nil || data[0] != version|typeNames {
+		t.Fatalf("Migrate(%v) with type names returns wrong data %v (err: %v)", structItem.data, data, err)
+	}
+	if actual, err := Unserialize(data, reg); err != nil || !defaultEq(structItem.value, actual) {
+		t.Errorf("Unserialize(%v) returns wrong value %#v (err: %v)", data, actual, err)
+	}
+	if data, err := Migrate(structItem.data, reg, 1); err == nil {
+		t.Errorf("Migrate() with invalid option must return error, but actual value is %v", data)
+	}
+
+	errItems := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{version1, tType, 50, tStruct, 0}, ErrUnknownTypeId},
+		{[]byte{version1, tString, 5, 'a'}, ErrUnexpectedEOF},
+		{[]byte{version1, tType, 19, tList, 1, tInterface, tRef, 9}, ErrBadReference},
+	}
+	for i, item := range errItems {
+		if _, err := unserializer.Decode(item.data); !errors.Is(err, item.err) {
+			t.Errorf("Test #%d: Decode(%v) must return error %q, but actual error is %v", i+1, item.data, item.err, err)
+		}
+	}
+}
+
+// Test_DecodeV1Golden decodes data produced by the serializer of version 1 (serializer_old.go of the v1 release);
+// the types are registered in the order in which the old serializer assigned ids to them
+func Test_DecodeV1Golden(t *testing.T) {
+	b := true
+	s3 := &testStruct3{f1: &b}
+	s3.f2 = s3.f1
+	s3.f3 = &s3.f1
+	ints := &[]int{1, 2}
+	arr := &[2]string{"x", "y"}
+	s1 := &testStruct1{f1: -1, F3: "ab", F4: 200, f5: "c"}
+	l := newLst()
+	l.push()
+	l.push()
+	items := []struct {
+		file    string
+		types   []any
+		options []any
+		value   any
+		eq      eq
+	}{
+		{
+			"references",
+			[]any{testStruct3{}, (*bool)(nil)},
+			nil,
+			s3,
+			func(expected, actual any) bool {
+				a := actual.(*testStruct3)
+				return defaultEq(expected, actual) && a.f2.(*bool) == a.f1 && a.f3.(**bool) == &a.f1
+			},
+		},
+		{
+			"container_pointers",
+			[]any{[]any{}, []int{}, map[string]int{}, [2]string{}},
+			nil,
+			[]any{ints, &map[string]int{"a": 1}, arr, ints, *arr},
+			func(expected, actual any) bool {
+				a := actual.([]any)
+				return defaultEq(expected, actual) && a[0].(*[]int) == a[3].(*[]int)
+			},
+		},
+		{
+			"name_mode_structs",
+			[]any{testStruct1{}, testStruct6{}, testStruct5{}},
+			[]any{StructCodingModeName},
+			testStruct5{F1: "x", F2: true, F3: s1, F4: testStruct6{f1: 5, F3: "y"}, f5: 3, f6: "z", f7: s1},
+			func(expected, actual any) bool {
+				a := actual.(testStruct5)
+				return defaultEq(expected, actual) && a.F3 == a.f7
+			},
+		},
+		{
+			"linked_list",
+			[]any{lst{}, testNode{}, (*testNode)(nil), (*lst)(nil)},
+			nil,
+			l,
+			func(expected, actual any) bool {
+				a := actual.(*lst)
+				return defaultEq(expected, actual) && a.root.next.next.next == &a.root && a.root.prev.lst == a
+			},
+		},
+	}
+	for i, item := range items {
+		data, err := os.ReadFile("testdata/v1/" + item.file + ".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg := NewTypeRegistry(false)
+		reg.RegisterBaseTypes()
+		for _, v := range item.types {
+			reg.RegisterTypeOf(v)
+		}
+		actual, err := Unserialize(data, append(item.options, reg)...)
+		if err != nil {
+			t.Errorf("Test #%d: Unserialize(%s) raises error: %q", i+1, item.file, err)
+		} else if res, err := equal(item.eq, item.value, actual); res == false {
+			t.Errorf("Test #%d: Unserialize(%s) returns wrong value %#v (check err: %v)", i+1, item.file, actual, err)
+		}
+	}
+}
+
+type limitedWriter struct {
+	limit int
+}
+
+var errWriteLimit = errors.New("write limit is reached")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errWriteLimit
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+// recordingWriter keeps the written data and the sizes of the writes
+type recordingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func Test_Encoder(t *testing.T) {
+	reg, _ := registry()
+	values := []any{
+		nil,
+		"abc",
+		[]any{1, true, strings.Repeat("a", 10000)},
+		testStruct6{f1: 1, F3: "a"},
+	}
+	buf := &bytes.Buffer{}
+	encoder := NewEncoder(buf).WithTypeRegistry(reg)
+	for i, v := range values {
+		buf.Reset()
+		if err := encoder.Encode(v); err != nil {
+			t.Errorf("Test #%d: Encode(%T) raises error: %q", i+1, v, err)
+		} else if expected := Serialize(v, reg); !bytes.Equal(expected, buf.Bytes()) {
+			t.Errorf("Test #%d: Encode(%T) must write %v, but actual data is %v", i+1, v, expected, buf.Bytes())
+		}
+	}
+	for _, limit := range []int{0, 100, 5000} {
+		err := NewEncoder(&limitedWriter{limit}).WithTypeRegistry(reg).Encode(values[2])
+		if !errors.Is(err, errWriteLimit) {
+			t.Errorf("Encode() to writer with limit %d must return error %q, but actual error is %v", limit, errWriteLimit, err)
+		}
+	}
+
+	// in name mode sizes of fields are measured in advance, so the fields are written while they are encoded
+	v := &testRequest{}
+	for i := 0; i < 1000; i++ {
+		v.Items = append(v.Items, testRequestItem{Name: fmt.Sprintf("item %d", i), Amount: int32(i)})
+	}
+	w := &recordingWriter{}
+	if err := NewEncoder(w).WithTypeRegistry(reg).WithStructCodingMode(StructCodingModeName).Encode(v); err != nil {
+		t.Fatalf("Encode() in name mode raises error: %q", err)
+	}
+	if expected := Serialize(v, reg, StructCodingModeName); !bytes.Equal(expected, w.Bytes()) {
+		t.Errorf("Encode() in name mode must write the same data as Serialize")
+	} else if len(w.writes) < 2 || w.writes[0] > 2*flushSize {
+		t.Errorf("Encode() in name mode must write the data before the end of the value, but writes are %v", w.writes)
+	}
+}
+
+func Test_Decoder(t *testing.T) {
+	reg, _ := registry()
+	values := []any{
+		nil,
+		"abc",
+		[]any{1, true, strings.Repeat("a", 10000)},
+		testStruct6{f1: 1, F3: "a"},
+		map[string]int{"a": 1},
+	}
+	var data []byte
+	for _, v := range values {
+		data = append(data, Serialize(v, reg)...)
+	}
+	readers := map[string]func(r io.Reader) io.Reader{
+		"reader":        func(r io.Reader) io.Reader { return r },
+		"one byte":      iotest.OneByteReader,
+		"half":          iotest.HalfReader,
+		"data with EOF": iotest.DataErrReader,
+	}
+	for name, reader := range readers {
+		decoder := NewDecoder(reader(bytes.NewReader(data))).WithTypeRegistry(reg)
+		for i, expected := range values {
+			actual, err := decoder.Decode()
+			if err != nil {
+				t.Errorf("%s: Test #%d: Decode() raises error: %q", name, i+1, err)
+			} else if !defaultEq(expected, actual) {
+				t.Errorf("%s: Test #%d: Decode() returns wrong value %#v", name, i+1, actual)
+			}
+		}
+		if actual, err := decoder.Decode(); err != io.EOF {
+			t.Errorf("%s: Decode() at the end of stream must return io.EOF, but actual result is %v, %v", name, actual, err)
+		}
+	}
+
+	truncated := data[:len(data)-1]
+	decoder := NewDecoder(iotest.OneByteReader(bytes.NewReader(truncated))).WithTypeRegistry(reg)
+	var err error
+	for err == nil {
+		_, err = decoder.Decode()
+	}
+	var decodeErr *DecodeError
+	if !errors.Is(err, ErrUnexpectedEOF) || !errors.As(err, &decodeErr) || decodeErr.Offset != len(truncated) {
+		t.Errorf("Decode() of truncated stream must return error %q at offset %d, but actual error is %v", ErrUnexpectedEOF, len(truncated), err)
+	}
+
+	errReader := io.MultiReader(bytes.NewReader(data[:5]), iotest.ErrReader(iotest.ErrTimeout))
+	decoder = NewDecoder(errReader).WithTypeRegistry(reg)
+	for err = nil; err == nil; {
+		_, err = decoder.Decode()
+	}
+	if !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("Decode() must return error of reader %q, but actual error is %v", iotest.ErrTimeout, err)
+	}
+
+	limited := NewDecoder(bytes.NewReader(data)).WithTypeRegistry(reg).WithLimits(Limits{MaxBytes: 100})
+	for i := 0; i < 2; i++ {
+		if _, err = limited.Decode(); err != nil {
+			t.Errorf("Test #%d: Decode() with limits raises error: %q", i+1, err)
+		}
+	}
+	if _, err = limited.Decode(); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Decode() of value longer than %d bytes must return error %q, but actual error is %v", 100, ErrLimitExceeded, err)
+	}
+}
+
+func Test_Framing(t *testing.T) {
+	reg, _ := registry()
+	values := []any{
+		"abc",
+		[]any{1, true, strings.Repeat("a", 10000)},
+		testStruct6{f1: 1, F3: "a"}, // the type is registered while the stream is written
+		[]testStruct6{{f1: 2}},
+		nil,
+	}
+	buf := &bytes.Buffer{}
+	encoder := NewEncoder(buf).WithTypeRegistry(reg).WithFraming()
+	for i, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			t.Fatalf("Test #%d: Encode(%T) raises error: %q", i+1, v, err)
+		}
+		if i == 1 {
+			message := append([]byte{version}, u2bs(1000, 3)...) // unknown type id
+			buf.Write(append(c2b(len(message)), message...))
+		}
+	}
+	data := buf.Bytes()
+
+	decoder := NewDecoder(iotest.OneByteReader(bytes.NewReader(data))).WithTypeRegistry(reg)
+	var actual []any
+	var errs []error
+	for decoder.More() {
+		if v, err := decoder.Next(); err != nil {
+			errs = append(errs, err)
+		} else {
+			actual = append(actual, v)
+		}
+	}
+	if !defaultEq(values, actual) {
+		t.Errorf("Next() returns wrong values %#v", actual)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrUnknownTypeId) {
+		t.Errorf("Next() must return error %q for the corrupted message only, but actual errors are %v", ErrUnknownTypeId, errs)
+	}
+	if v, err := decoder.Next(); err != io.EOF {
+		t.Errorf("Next() at the end of stream must return io.EOF, but actual result is %v, %v", v, err)
+	}
+
+	decoder = NewDecoder(bytes.NewReader(data[:len(data)-1])).WithTypeRegistry(reg)
+	var err error
+	for err == nil || errors.Is(err, ErrUnknownTypeId) {
+		_, err = decoder.Next()
+	}
+	if decoder.More() {
+		t.Errorf("More() must return false after the stream is broken")
+	}
+	if !errors.Is(err, ErrUnexpectedEOF) {
+		t.Errorf("Next() of truncated message must return error %q, but actual error is %v", ErrUnexpectedEOF, err)
+	}
+
+	decoder = NewDecoder(bytes.NewReader(data)).WithTypeRegistry(reg).WithLimits(Limits{MaxBytes: 100})
+	decoder.Next()
+	if _, err = decoder.Next(); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Next() of message longer than %d bytes must return error %q, but actual error is %v", 100, ErrLimitExceeded, err)
+	}
+	if v, err := decoder.Next(); err == nil || !errors.Is(err, ErrUnknownTypeId) {
+		t.Errorf("Next() after too long message must read the next message, but actual result is %v, %v", v, err)
+	}
+}
+
+func Test_TypeIdModeName(t *testing.T) {
+	producer := NewTypeRegistry(false)
+	producer.RegisterBaseTypes()
+	producer.RegisterTypeOf(testStruct6{})
+	producer.RegisterTypeOf([]any{})
+	producer.RegisterTypeOf(map[string]testStruct6{})
+	consumer := NewTypeRegistry(false)
+	consumer.RegisterTypeOf([]any{})
+	consumer.RegisterTypeOf(map[string]testStruct6{})
+	consumer.RegisterBaseTypes()
+	consumer.RegisterTypeOf(testStruct6{})
+
+	data := Serialize(true, producer, TypeIdModeName)
+	if expected := []byte{version | typeNames, 0b001_00010, 0b0001_0100, 'b', 'o', 'o', 'l', meta_tru}; !bytes.Equal(expected, data) {
+		t.Errorf("Serialize(true) must return %v, but actual value is %v", expected, data)
+	}
+	values := []any{
+		nil,
+		true,
+		[]any{1, "a", testStruct6{f1: 1}, []any{2, testStruct6{F3: "b"}}},
+		map[string]testStruct6{"a": {F4: 1}},
+	}
+	for i, expected := range values {
+		data := Serialize(expected, producer, TypeIdModeName)
+		if actual, err := Unserialize(data, consumer); err != nil {
+			t.Errorf("Test #%d: Unserialize(%v) raises error: %q", i+1, data, err)
+		} else if !defaultEq(expected, actual) {
+			t.Errorf("Test #%d: Unserialize(%v) returns wrong value %#v", i+1, data, actual)
+		}
+	}
+
+	unknown := NewTypeRegistry(false)
+	unknown.RegisterBaseTypes()
+	data = Serialize(values[2], producer, TypeIdModeName)
+	if _, err := Unserialize(data, unknown); !errors.Is(err, ErrUnknownTypeId) {
+		t.Errorf("Unserialize(%v) must return error %q, but actual error is %v", data, ErrUnknownTypeId, err)
+	}
+}
+
+func Test_DecodeInto(t *testing.T) {
+	producer := NewTypeRegistry(false)
+	producer.RegisterBaseTypes()
+	producer.RegisterTypeOf(testStruct6{})
+	consumer := NewTypeRegistry(false)
+	consumer.RegisterBaseTypes()
+
+	expected := testStruct6{f1: 1, f2: true, F3: "a", F4: 2, f5: "b"}
+	data := Serialize(expected, producer)
+	actual := &testStruct6{f1: 5}
+	ptr := actual
+	if err := NewUnserializer().WithTypeRegistry(consumer).DecodeInto(data, actual); err != nil {
+		t.Errorf("DecodeInto(%v) raises error: %q", data, err)
+	} else if *actual != expected || ptr != actual {
+		t.Errorf("DecodeInto(%v) decodes wrong value %#v", data, *actual)
+	}
+	for _, mode := range []TypeIdMode{TypeIdModeRegistry, TypeIdModeName} {
+		data := Serialize(expected, producer, mode)
+		if actual, err := UnserializeAs[testStruct6](data, consumer); err != nil {
+			t.Errorf("UnserializeAs(%v) raises error: %q", data, err)
+		} else if actual != expected {
+			t.Errorf("UnserializeAs(%v) returns wrong value %#v", data, actual)
+		}
+	}
+
+	if actual, err := UnserializeAs[int](Serialize(123)); err != nil || actual != 123 {
+		t.Errorf("UnserializeAs[int] returns %v, %v", actual, err)
+	}
+	if actual, err := UnserializeAs[[]any](Serialize([]any{1, "a"})); err != nil || !defaultEq([]any{1, "a"}, actual) {
+		t.Errorf("UnserializeAs[[]any] returns %v, %v", actual, err)
+	}
+	if actual, err := UnserializeAs[any](Serialize("a")); err != nil || actual != "a" {
+		t.Errorf("UnserializeAs[any] returns %v, %v", actual, err)
+	}
+	if actual, err := UnserializeAs[fmt.Stringer](Serialize(nil)); err != nil || actual != nil {
+		t.Errorf("UnserializeAs[fmt.Stringer] returns %v, %v", actual, err)
+	}
+	if actual, err := UnserializeAs[*int](Serialize(nil)); err != nil || actual != nil {
+		t.Errorf("UnserializeAs[*int] returns %v, %v", actual, err)
+	}
+
+	if _, err := UnserializeAs[string](Serialize(123)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("UnserializeAs[string](123) must return error %q, but actual error is %v", ErrTypeMismatch, err)
+	}
+	if _, err := UnserializeAs[fmt.Stringer](Serialize(123)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("UnserializeAs[fmt.Stringer](123) must return error %q, but actual error is %v", ErrTypeMismatch, err)
+	}
+	if _, err := UnserializeAs[any](Serialize(expected, producer), consumer); !errors.Is(err, ErrUnknownTypeId) {
+		t.Errorf("UnserializeAs[any] must return error %q, but actual error is %v", ErrUnknownTypeId, err)
+	}
+	if err := NewUnserializer().DecodeInto(Serialize(1), 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("DecodeInto(1) must return error %q, but actual error is %v", ErrTypeMismatch, err)
+	}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf).WithTypeRegistry(producer)
+	encoder.Encode(expected)
+	encoder.Encode(expected)
+	decoder := NewDecoder(&buf).WithTypeRegistry(consumer)
+	for i := 0; i < 2; i++ {
+		var actual testStruct6
+		if err := decoder.DecodeInto(&actual); err != nil || actual != expected {
+			t.Errorf("Decoder.DecodeInto returns %#v, %v", actual, err)
+		}
+	}
+	var v testStruct6
+	if err := decoder.DecodeInto(&v); err != io.EOF {
+		t.Errorf("Decoder.DecodeInto must return io.EOF, but actual error is %v", err)
+	}
+}
+
+func Test_AppendEncode(t *testing.T) {
+	value := benchmarkRequest()
+	value.Headers = nil // the order of map entries is random
+	serializer := NewSerializer()
+	expected := serializer.Encode(value)
+	prefix := []byte{1, 2, 3}
+	data := serializer.AppendEncode(append(make([]byte, 0, 1024), prefix...), value)
+	if !bytes.Equal(data[:len(prefix)], prefix) || !bytes.Equal(data[len(prefix):], expected) {
+		t.Errorf("AppendEncode must append %v to %v, but actual data is %v", expected, prefix, data)
+	}
+	if actual := serializer.AppendEncode(data[:0], value); !bytes.Equal(actual, expected) || &actual[0] != &data[0] {
+		t.Errorf("AppendEncode must reuse the buffer of dst")
+	}
+	// the memory of the value graph is reused too, only copies of map entries are allocated
+	if allocs := testing.AllocsPerRun(100, func() { data = serializer.AppendEncode(data[:0], value) }); allocs != 0 {
+		t.Errorf("AppendEncode must not allocate, but it makes %v allocations", allocs)
+	}
+
+	for _, v := range []uint64{0, 1, 15, 16, 4095, 4096, 1 << 32, math.MaxUint64} {
+		for _, sizeBits := range []int{2, 3, 4} {
+			if actual := appendU2bs([]byte{9}, v, sizeBits); !bytes.Equal(actual, append([]byte{9}, u2bs(v, sizeBits)...)) {
+				t.Errorf("appendU2bs(%d, %d) returns %v", v, sizeBits, actual)
+			}
+		}
+	}
+	buf := make([]byte, 0, 16)
+	if allocs := testing.AllocsPerRun(100, func() { buf = appendU2bs(buf[:0], math.MaxUint64, 4) }); allocs != 0 {
+		t.Errorf("appendU2bs must not allocate, but it makes %v allocations", allocs)
+	}
+
+	// the streaming encoding writes the data by chunks
+	large := make([]string, 1000)
+	for i := range large {
+		large[i] = strings.Repeat("x", i%50)
+	}
+	var stream bytes.Buffer
+	if err := NewEncoder(&stream).Encode(large); err != nil {
+		t.Fatal(err)
+	}
+	if expected := Serialize(large); !bytes.Equal(stream.Bytes(), expected) {
+		t.Errorf("Encoder must write the same data as Serialize")
+	}
+}
+
+func benchmarkRequest() *testRequest {
+	r := &testRequest{
+		Id:      123456,
+		Method:  "orders.create",
+		Tags:    []string{"a", "b", "c"},
+		Headers: map[string]string{"trace": "abc", "user": "42"},
+	}
+	for i := 0; i < 20; i++ {
+		r.Items = append(r.Items, testRequestItem{Name: fmt.Sprintf("item %d", i), Price: float64(i) * 1.5, Amount: int32(i), Valid: i%2 == 0})
+	}
+	r.Parent = &testRequest{Id: 1, Method: "batch"}
+	return r
+}
+
+func BenchmarkEncode(b *testing.B) {
+	reg := NewTypeRegistry(true)
+	serializer := NewSerializer().WithTypeRegistry(reg)
+	value := benchmarkRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serializer.Encode(value)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	reg := NewTypeRegistry(true)
+	data := Serialize(benchmarkRequest(), reg)
+	unserializer := NewUnserializer().WithTypeRegistry(reg)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := unserializer.Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	reg := NewTypeRegistry(true)
+	serializer := NewSerializer().WithTypeRegistry(reg)
+	value := benchmarkRequest()
+	var data []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data = serializer.AppendEncode(data[:0], value)
+	}
+}
+
+func BenchmarkU2bs(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		u2bs(uint64(i), 4)
+	}
+}
+
+func BenchmarkAppendU2bs(b *testing.B) {
+	buf := make([]byte, 0, 16)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = appendU2bs(buf[:0], uint64(i), 4)
+	}
+}
@@ -0,0 +1,195 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Decoder reads and decodes values from an input stream.
+// Bytes are read on demand, so the stream is never read entirely into memory.
+//
+// Values written by Encoder with framing are read as messages with More and Next.
+// The options (e.g. the type registry) are shared by all values of the stream.
+//
+// The decoder given to CodecMarshaler.UnmarshalCodec is nested: it returns the values
+// written by MarshalCodec, which are already decoded with the enclosing value.
+type Decoder struct {
+	unserializer *Unserializer
+	message      *Unserializer // unserializer of the message read by Next
+	err          error         // error that breaks the stream, it is returned by all subsequent calls
+	nested       bool
+	values       []any         // values of the nested decoder that are not read yet
+	parent       *Unserializer // unserializer of the value the nested decoder belongs to
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	u := NewUnserializer()
+	u.r = r
+	return &Decoder{
+		unserializer: u,
+	}
+}
+
+func (d *Decoder) WithOptions(options []any) *Decoder {
+	d.unserializer.WithOptions(options)
+	return d
+}
+
+func (d *Decoder) WithTypeRegistry(registry *TypeRegistry) *Decoder {
+	d.unserializer.WithTypeRegistry(registry)
+	return d
+}
+
+func (d *Decoder) WithStructCodingMode(mode StructCodingMode) *Decoder {
+	d.unserializer.WithStructCodingMode(mode)
+	return d
+}
+
+func (d *Decoder) WithLimits(limits Limits) *Decoder {
+	d.unserializer.WithLimits(limits)
+	return d
+}
+
+// Decode reads the next encoded value from the stream and decodes it.
+// It returns io.EOF if the stream has no more data, and an error wrapping ErrUnexpectedEOF
+// if the stream ends in the middle of the value. After an error the rest of the stream cannot be decoded.
+func (d *Decoder) Decode() (value any, err error) {
+	if err = d.checkEOF(); err != nil {
+		return nil, err
+	}
+	if d.nested {
+		return d.nextValue(), nil
+	}
+	if value, err = d.unserializer.decodeData(); err != nil {
+		d.err = err
+	}
+	return value, err
+}
+
+// DecodeInto reads the next encoded value from the stream and decodes it directly into the value ptr points to
+// (see Unserializer.DecodeInto). Errors are handled the same way as in Decode.
+func (d *Decoder) DecodeInto(ptr any) (err error) {
+	if d.nested {
+		return d.decodeValueInto(ptr)
+	}
+	if err = d.unserializer.setRoot(ptr); err != nil {
+		return err
+	}
+	defer d.unserializer.setRoot(nil)
+	_, err = d.Decode()
+	return err
+}
+
+// More reports whether the stream has more data to decode and it is not broken by an error
+func (d *Decoder) More() bool {
+	return d.checkEOF() == nil
+}
+
+// Next reads the next length-prefixed message from the stream and decodes its value.
+// An error of the message decoding does not break the stream, so the next messages can be read.
+// It returns io.EOF if the stream has no more messages.
+func (d *Decoder) Next() (any, error) {
+	if err := d.checkEOF(); err != nil {
+		return nil, err
+	}
+	if d.nested {
+		return d.nextValue(), nil
+	}
+	data, err := d.readMessage()
+	if err != nil {
+		// too long messages are skipped, other errors mean that the message boundaries are lost
+		if !errors.Is(err, ErrLimitExceeded) {
+			d.err = err
+		}
+		return nil, err
+	}
+	if d.message == nil {
+		d.message = &Unserializer{}
+	}
+	u := d.unserializer
+	d.message.typeRegistry = u.typeRegistry
+	d.message.structCodingMode = u.structCodingMode
+	d.message.limits = u.limits
+	return d.message.Decode(data)
+}
+
+func (d *Decoder) readMessage() (data []byte, err error) {
+	u := d.unserializer
+	defer func() {
+		if e := recover(); e != nil {
+			err = &DecodeError{
+				Err:    errorOf(e),
+				Offset: u.offset + u.pos,
+				NodeId: -1,
+			}
+		}
+	}()
+	u.start = u.offset + u.pos
+	length := u.decodeSize("message length", 0)
+	u.start = u.offset + u.pos
+	if exceeds(length, u.limits.MaxBytes) {
+		u.skip(length)
+		checkLimit("message length", length, u.limits.MaxBytes)
+	}
+	return u.readBytes(length), nil
+}
+
+func (d *Decoder) nextValue() any {
+	v := d.values[0]
+	d.values = d.values[1:]
+	return v
+}
+
+// decodeValueInto sets the value ptr points to to the next value of the nested decoder
+func (d *Decoder) decodeValueInto(ptr any) error {
+	p := reflect.ValueOf(ptr)
+	if p.Kind() != reflect.Pointer || p.IsNil() {
+		return fmt.Errorf("%w: value of type %T cannot be decoded into, non-nil pointer is required", ErrTypeMismatch, ptr)
+	}
+	if err := d.checkEOF(); err != nil {
+		return err
+	}
+	target, v := p.Elem(), reflect.ValueOf(d.values[0])
+	switch {
+	case !v.IsValid():
+		if !isNillable(target.Type()) {
+			return typeMismatchError(target.Type(), nil)
+		}
+		target.SetZero()
+	case v.Type().AssignableTo(target.Type()):
+		target.Set(v)
+	default:
+		return typeMismatchError(target.Type(), v.Type())
+	}
+	// the pointer to a value placed later in data is restored in the target as well
+	if err := d.parent.copyForwardAny(&d.values[0], target); err != nil {
+		return err
+	}
+	d.nextValue()
+	return nil
+}
+
+// checkEOF returns io.EOF if the stream has no more data, or an error of the stream
+func (d *Decoder) checkEOF() (err error) {
+	if d.err != nil {
+		return d.err
+	}
+	if d.nested {
+		if len(d.values) == 0 {
+			return io.EOF
+		}
+		return nil
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = errorOf(e)
+			d.err = err
+		}
+	}()
+	if !d.unserializer.fill(1) {
+		return io.EOF
+	}
+	return nil
+}
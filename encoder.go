@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder writes encoded values to an output stream.
+// Encoded bytes are written through a buffer while the value is traversed,
+// so the whole encoded data is never kept in memory. The graph of the value built to find shared values
+// takes memory proportional to the number of values that can be shared (strings, slices, maps, pointers,
+// structs and their fields), while elements and fields of scalar types (numbers, booleans) take none.
+// In StructCodingModeName the value is encoded twice: first without writing to measure the sizes of the fields
+// written before their values, so marshalers must return the same data on both calls.
+//
+// With framing each value is written as a message prefixed with its length,
+// so the messages can be read one by one with Decoder.Next.
+//
+// The encoder given to CodecMarshaler.MarshalCodec is nested: it collects the values
+// which are then encoded by the serializer of the enclosing value.
+type Encoder struct {
+	serializer *Serializer
+	w          *bufio.Writer
+	framing    bool
+	message    []byte // encoded value of the message being written
+	nested     bool
+	values     []any // values collected by the nested encoder
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		serializer: NewSerializer(),
+		w:          bufio.NewWriter(w),
+	}
+}
+
+func (e *Encoder) WithOptions(options []any) *Encoder {
+	e.serializer.WithOptions(options)
+	return e
+}
+
+func (e *Encoder) WithTypeRegistry(registry *TypeRegistry) *Encoder {
+	e.serializer.WithTypeRegistry(registry)
+	return e
+}
+
+func (e *Encoder) WithStructCodingMode(mode StructCodingMode) *Encoder {
+	e.serializer.WithStructCodingMode(mode)
+	return e
+}
+
+func (e *Encoder) WithTypeIdMode(mode TypeIdMode) *Encoder {
+	e.serializer.WithTypeIdMode(mode)
+	return e
+}
+
+// WithFraming makes the encoder write values as length-prefixed messages.
+// Each message is encoded in memory before writing, so a failed message is never written partially.
+func (e *Encoder) WithFraming() *Encoder {
+	e.framing = true
+	return e
+}
+
+// Encode writes encoded value v to the stream and flushes the buffer.
+// It returns the first error of the underlying writer or an error of the encoding;
+// after an error the stream may contain a part of the encoded value.
+func (e *Encoder) Encode(v any) (err error) {
+	if e.nested {
+		e.values = append(e.values, v)
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errorOf(r)
+		}
+	}()
+	if !e.framing {
+		e.serializer.encodeTo(e.w, v)
+		return e.w.Flush()
+	}
+	e.message = e.serializer.AppendEncode(e.message[:0], v)
+	var length [9]byte
+	if _, err = e.w.Write(appendU2bs(length[:0], uint64(len(e.message)), 4)); err == nil {
+		_, err = e.w.Write(e.message)
+	}
+	if err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,68 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+var (
+	ErrUnexpectedEOF   = io.ErrUnexpectedEOF
+	ErrUnknownTypeId   = errors.New("unknown type id")
+	ErrBadReference    = errors.New("bad reference")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrTypeMismatch    = errors.New("type mismatch")
+	ErrLimitExceeded   = errors.New("limit exceeded")
+)
+
+// DecodeError describes an error occurred while decoding data
+type DecodeError struct {
+	Err    error  // cause of the error, e.g. one of Err* variables
+	Offset int    // offset of the byte being decoded
+	NodeId int    // id of the node being decoded, -1 if no node has been decoded yet
+	Path   string // types of the values from the root value to the value being decoded (the middle of long paths is omitted)
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s [offset: %d, node: %d, path: %s]", e.Err, e.Offset, e.NodeId, e.Path)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// errorOf converts a value recovered from panic to error
+func errorOf(e any) error {
+	if err, ok := e.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", e)
+}
+
+func typeMismatchError(expected, actual reflect.Type) error {
+	return fmt.Errorf("%w: value of type %s cannot be used as %s", ErrTypeMismatch, typeString(actual), typeString(expected))
+}
+
+// maxPathTypes is the number of types kept at each end of the path of deeply nested values
+const maxPathTypes = 8
+
+func typePath(types []reflect.Type) string {
+	if len(types) > 2*maxPathTypes+1 {
+		skipped := fmt.Sprintf("(%d types)", len(types)-2*maxPathTypes)
+		return typePath(types[:maxPathTypes]) + " > " + skipped + " > " + typePath(types[len(types)-maxPathTypes:])
+	}
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = typeString(t)
+	}
+	return strings.Join(names, " > ")
+}
+
+func typeString(t reflect.Type) string {
+	if t == nil {
+		return "nil"
+	}
+	return t.String()
+}
@@ -7,7 +7,9 @@ import (
 
 type valueAddr struct {
 	ptr      unsafe.Pointer
-	typeName string
+	typ      reflect.Type
+	length   int // strings and slices sharing memory are different values if their lengths differ
+	capacity int
 }
 
 type nodeValue struct {
@@ -20,39 +22,120 @@ func (a valueAddr) isValid() bool {
 	return a.ptr != nil
 }
 
+// scalarNode is the child of a struct or list node in place of the container of a scalar field or element
+// (see typePlan), which has no node, but takes the ids of the container and its value in the encoded data
+const scalarNode = -1
+
+// graphNode is a node of the value graph. Nodes are identified by their indexes in the graph,
+// which never change, while ids of the encoded data are assigned to the nodes by graph.number.
+type graphNode struct {
+	v           reflect.Value
+	childs      []int
+	parent      int  // the first parent of the node, it owns the node if the node is a container
+	container   bool // element of a slice or an array, or field of a struct
+	scalarElems bool // list of scalar elements, which have no nodes until they get children (see scalarNode)
+	id          int  // id of the node in the encoded data, -1 until the node is numbered
+	end         int  // id following the ids of the node and the descendants numbered inside it
+	visited     bool // the node is already encoded, so it is encoded as a reference from now on
+	open        bool // descendants of the node are being traversed
+}
+
+// nodePageSize is the number of nodes allocated at once. Nodes are kept in pages instead of a slice,
+// so a growing graph does not copy its nodes, and nodes are never moved in memory.
+const nodePageSize = 1024
+
 type graph struct {
-	childs map[int][]int
-	prnts  map[int][]int
-	vmap   map[int]struct{}
-	values map[int]nodeValue
-	tvals  map[int]nodeValue
-	addrs  map[valueAddr]int
-	cntrs  map[valueAddr]int
+	pages      [][]graphNode
+	count      int // number of nodes
+	addrs      map[valueAddr]int
+	cntrs      map[valueAddr]int
+	scalarPtrs int // number of pointers to scalar values, which can be elements or fields without nodes
+	nextId     int
 }
 
 func newGraph() *graph {
 	return &graph{
-		childs: make(map[int][]int),
-		prnts:  make(map[int][]int),
-		vmap:   make(map[int]struct{}),
-		values: make(map[int]nodeValue),
-		addrs:  make(map[valueAddr]int),
-		cntrs:  make(map[valueAddr]int),
+		addrs: make(map[valueAddr]int),
+		cntrs: make(map[valueAddr]int),
+	}
+}
+
+// reset clears the graph keeping the allocated memory for the next value:
+// the nodes keep their slices of children, which are reused by the nodes of the next value
+func (g *graph) reset() {
+	for nodeId := 0; nodeId < g.count; nodeId++ {
+		node := g.node(nodeId)
+		*node = graphNode{childs: node.childs[:0]}
+	}
+	g.count = 0
+	clear(g.addrs)
+	clear(g.cntrs)
+	g.scalarPtrs = 0
+	g.nextId = 0
+}
+
+func (g *graph) node(nodeId int) *graphNode {
+	return &g.pages[nodeId/nodePageSize][nodeId%nodePageSize]
+}
+
+// len returns the number of nodes
+func (g *graph) len() int {
+	return g.count
+}
+
+// newNode adds a node with the given value to the children of the parent node (if parentId is not negative)
+// and returns index of the node
+func (g *graph) newNode(parentId int, value nodeValue) int {
+	nodeId := g.count
+	if nodeId == len(g.pages)*nodePageSize {
+		g.pages = append(g.pages, make([]graphNode, nodePageSize))
 	}
+	g.count++
+	node := g.node(nodeId)
+	*node = graphNode{childs: node.childs[:0], parent: parentId, id: -1}
+	if parentId >= 0 {
+		g.addNode(nodeId, parentId)
+	}
+	g.addNodeValue(nodeId, value)
+	return nodeId
 }
 
-func (g *graph) addNodeWithValue(childId, parentId int, value nodeValue) {
-	g.addNode(childId, parentId)
-	g.addNodeValue(childId, value)
+// newContainer adds a container node owned by the parent node
+func (g *graph) newContainer(parentId int, value nodeValue) int {
+	nodeId := g.newNode(parentId, value)
+	g.node(nodeId).container = true
+	return nodeId
+}
+
+// setScalarElems marks the list node as a list of scalar elements, which have no nodes
+func (g *graph) setScalarElems(nodeId int) {
+	g.node(nodeId).scalarElems = true
+}
+
+// newScalarContainer adds the container node of the scalar element or field of the parent node
+// at the given position and moves the element of the pointer node to it
+func (g *graph) newScalarContainer(parentId, position, ptrId int, value nodeValue) {
+	containerId := g.newNode(-1, value)
+	container, parent := g.node(containerId), g.node(parentId)
+	container.container = true
+	container.parent = parentId
+	if parent.scalarElems && len(parent.childs) == 0 {
+		for i, length := 0, parent.v.Len(); i < length; i++ {
+			parent.childs = append(parent.childs, scalarNode)
+		}
+	}
+	parent.childs[position] = containerId
+	g.takeOver(ptrId, containerId)
 }
 
 func (g *graph) addNode(childId, parentId int) {
-	g.childs[parentId] = append(g.childs[parentId], childId)
-	g.prnts[childId] = append(g.prnts[childId], parentId)
+	parent := g.node(parentId)
+	parent.childs = append(parent.childs, childId)
 }
 
+// addNodeValue sets the value of the node and registers the node at the addresses of the value
 func (g *graph) addNodeValue(nodeId int, value nodeValue) {
-	g.values[nodeId] = value
+	g.node(nodeId).v = value.v
 	if value.addr.isValid() {
 		g.addrs[value.addr] = nodeId
 	}
@@ -61,38 +144,26 @@ func (g *graph) addNodeValue(nodeId int, value nodeValue) {
 	}
 }
 
-func (g *graph) updateNodeValue(nodeId int, oldValue, newValue nodeValue) {
-	v := &oldValue
-	if newValue.v.IsValid() {
-		v.v = newValue.v
-	}
-	if newValue.addr.isValid() {
-		if v.addr.isValid() {
-			delete(g.addrs, v.addr)
-		}
-		v.addr = newValue.addr
-		g.addrs[v.addr] = nodeId
-	}
-	if newValue.cntr.isValid() {
-		if v.cntr.isValid() {
-			delete(g.cntrs, v.cntr)
-		}
-		v.cntr = newValue.cntr
-		g.cntrs[v.cntr] = nodeId
-	}
-	g.values[nodeId] = *v
+// addContainerAddr registers the node at the address of the container
+// (the pointer node is registered at the address of its element)
+func (g *graph) addContainerAddr(nodeId int, addr valueAddr) {
+	g.cntrs[addr] = nodeId
 }
 
-func (g *graph) get(nodeId int) reflect.Value {
-	return g.values[nodeId].v
+// takeOver moves the element of the pointer node to the container node which holds the element's memory,
+// so the element is encoded inside the container and the pointer refers to the container
+func (g *graph) takeOver(ptrId, containerId int) {
+	ptr, container := g.node(ptrId), g.node(containerId)
+	container.childs = append(container.childs, ptr.childs[0])
+	ptr.childs[0] = containerId
 }
 
-func (g *graph) nodeValue(nodeId int) nodeValue {
-	return g.values[nodeId]
+func (g *graph) get(nodeId int) reflect.Value {
+	return g.node(nodeId).v
 }
 
 func (g *graph) children(parentId int) []int {
-	return g.childs[parentId]
+	return g.node(parentId).childs
 }
 
 func (g *graph) nodeAt(addr valueAddr) (int, bool) {
@@ -105,156 +176,75 @@ func (g *graph) containerNodeAt(addr valueAddr) (int, bool) {
 	return nodeId, exists
 }
 
-func (g *graph) isVisited(nodeId int) bool {
-	_, exists := g.vmap[nodeId]
-	return exists
+func (g *graph) hasScalarElems(nodeId int) bool {
+	return g.node(nodeId).scalarElems
 }
 
-func (g *graph) visit(nodeId int) {
-	g.vmap[nodeId] = struct{}{}
+func (g *graph) isContainer(nodeId int) bool {
+	return g.node(nodeId).container
 }
 
-func (g *graph) renumber(currentNodeId, breakNodeId int) {
-	maxNodeId := g.findMaxNodeId(breakNodeId, breakNodeId, breakNodeId, make(map[int]struct{}))
-
-	inc := currentNodeId - maxNodeId
-	dec := maxNodeId - breakNodeId + 1
-	g.tvals = make(map[int]nodeValue)
-
-	g.renumberBorderNodes(breakNodeId, maxNodeId, inc, dec)
-	prnts := g.renumberParents(breakNodeId, currentNodeId, maxNodeId, inc, dec)
-	childs := g.renumberChilds(breakNodeId, currentNodeId, maxNodeId, inc, dec, prnts)
-
-	currentNodeId -= dec
-	breakNodeId += inc
-	prnts[currentNodeId] = append(prnts[currentNodeId], prnts[breakNodeId]...)
-	prnts[breakNodeId] = []int{currentNodeId}
-	childs[currentNodeId] = []int{breakNodeId}
-
-	g.childs = g.merge(g.childs, childs)
-	g.prnts = g.merge(g.prnts, prnts)
-	g.restoreMeta()
+func (g *graph) isOpen(nodeId int) bool {
+	return g.node(nodeId).open
 }
 
-func (g *graph) findMaxNodeId(parentNodeId, minNodeId, maxNodeId int, vmap map[int]struct{}) int {
-	for _, nodeId := range g.childs[parentNodeId] {
-		if nodeId <= minNodeId {
-			continue
-		}
-		if _, visited := vmap[nodeId]; visited {
-			continue
-		}
-		vmap[nodeId] = struct{}{}
-		if nodeId > maxNodeId {
-			maxNodeId = nodeId
-		}
-		maxNodeId = g.findMaxNodeId(nodeId, minNodeId, maxNodeId, vmap)
-	}
-	return maxNodeId
+func (g *graph) setOpen(nodeId int, open bool) {
+	g.node(nodeId).open = open
 }
 
-func (g *graph) renumberBorderNodes(startNodeId, turnNodeId, inc, dec int) {
-	borderParents := append(g.prnts[turnNodeId+1], g.prnts[startNodeId]...)
-	for _, parentId := range borderParents {
-		if parentId >= startNodeId {
-			continue
-		}
-		childs := g.childs[parentId]
-		for i, childId := range childs {
-			if childId >= startNodeId {
-				childs[i] = g.renumberNodeId(childId, turnNodeId, inc-1, dec)
-			}
-		}
-	}
+func (g *graph) isVisited(nodeId int) bool {
+	return g.node(nodeId).visited
 }
 
-func (g *graph) renumberParents(startNodeId, endNodeId, turnNodeId, inc, dec int) map[int][]int {
-	prnts := make(map[int][]int)
-	for nodeId := startNodeId; nodeId <= endNodeId; nodeId++ {
-		elems := g.prnts[nodeId]
-		if len(elems) == 0 {
-			continue
-		}
-		for i, id := range elems {
-			if id < startNodeId {
-				elems[i] = id
-			} else {
-				elems[i] = g.renumberNodeId(id, turnNodeId, inc, dec)
-			}
-		}
-		prnts[g.renumberNodeId(nodeId, turnNodeId, inc, dec)] = elems
-		delete(g.prnts, nodeId)
-	}
-	return prnts
+func (g *graph) visit(nodeId int) {
+	g.node(nodeId).visited = true
 }
 
-func (g *graph) renumberChilds(startNodeId, endNodeId, turnNodeId, inc, dec int, prnts map[int][]int) map[int][]int {
-	childs := make(map[int][]int)
-	for nodeId := startNodeId; nodeId <= endNodeId; nodeId++ {
-		elems := g.childs[nodeId]
-		if len(elems) == 0 {
-			continue
-		}
-		for i, id := range elems {
-			if id >= startNodeId {
-				elems[i] = g.renumberNodeId(id, turnNodeId, inc, dec)
-				continue
-			}
-			elems[i] = id
-			parents := g.prnts[id]
-			if parents == nil {
-				continue
-			}
-			for j, parentId := range parents {
-				if parentId >= startNodeId {
-					parents[j] = g.renumberNodeId(parentId, turnNodeId, inc, dec)
-				}
-			}
-			prnts[id] = parents
-			delete(g.prnts, id)
-		}
-		childs[g.renumberNodeId(nodeId, turnNodeId, inc, dec)] = elems
-		delete(g.childs, nodeId)
+// unvisit marks all nodes as not encoded, so the value can be encoded again
+func (g *graph) unvisit() {
+	for nodeId := 0; nodeId < g.count; nodeId++ {
+		g.node(nodeId).visited = false
 	}
-	return childs
 }
 
-func (g *graph) renumberNodeId(nodeId, turnNodeId, inc, dec int) int {
-	id := nodeId
-	if nodeId <= turnNodeId {
-		id += inc
-	} else {
-		id -= dec
-	}
-	g.rebindMeta(nodeId, id)
-	return id
+// id returns id of the node in the encoded data
+func (g *graph) id(nodeId int) int {
+	return g.node(nodeId).id
 }
 
-func (g *graph) rebindMeta(oldNodeId, newNodeId int) {
-	if v, exists := g.values[oldNodeId]; exists {
-		g.tvals[newNodeId] = v
-	}
+// idCount returns the number of ids taken by the node and its descendants in the encoded data
+func (g *graph) idCount(nodeId int) int {
+	node := g.node(nodeId)
+	return node.end - node.id
 }
 
-func (g *graph) restoreMeta() {
-	for nodeId, v := range g.tvals {
-		g.values[nodeId] = v
-		if v.addr.isValid() {
-			g.addrs[v.addr] = nodeId
-		}
-		if v.cntr.isValid() {
-			g.cntrs[v.cntr] = nodeId
-		}
-	}
-	g.tvals = nil
+// number assigns ids to the nodes of the graph starting from the root node in the order the nodes are encoded:
+// a node gets the next id where it is reached first, except containers which get ids where their owners are
+func (g *graph) number() {
+	g.numberNode(0)
 }
 
-func (g *graph) merge(nodes1, nodes2 map[int][]int) map[int][]int {
-	if len(nodes2) > len(nodes1) {
-		nodes1, nodes2 = nodes2, nodes1
+func (g *graph) numberNode(nodeId int) {
+	node := g.node(nodeId)
+	if node.id >= 0 {
+		return
+	}
+	node.id = g.nextId
+	g.nextId++
+	if node.scalarElems && len(node.childs) == 0 {
+		g.nextId += 2 * node.v.Len()
+		node.end = g.nextId
+		return
 	}
-	for nodeId, nodes := range nodes2 {
-		nodes1[nodeId] = nodes
+	for _, childId := range node.childs {
+		if childId == scalarNode {
+			g.nextId += 2 // ids of the container and its value
+			continue
+		}
+		if child := g.node(childId); child.container && child.parent != nodeId {
+			continue // pointer to the container
+		}
+		g.numberNode(childId)
 	}
-	return nodes1
+	node.end = g.nextId
 }
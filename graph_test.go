@@ -9,11 +9,19 @@ type node struct {
 	childId, parentId int
 }
 
+type testGraphItem struct {
+	A, B int
+}
+
+type testGraphBackPointers struct {
+	Ptrs  []*int
+	Items []testGraphItem
+}
+
 func TestGraph_Add(t *testing.T) {
 	items := []struct {
-		nodes   []node
-		childs  map[int][]int
-		parents map[int][]int
+		nodes  []node
+		childs map[int][]int
 	}{
 		// #1
 		{
@@ -29,15 +37,6 @@ func TestGraph_Add(t *testing.T) {
 				3: {6},
 				6: {7},
 			},
-			map[int][]int{
-				1: {0},
-				2: {0},
-				3: {0},
-				4: {1},
-				5: {1},
-				6: {3},
-				7: {6},
-			},
 		},
 		// #2
 		{
@@ -65,166 +64,166 @@ func TestGraph_Add(t *testing.T) {
 				12: {13, 14},
 				13: {7},
 			},
-			map[int][]int{
-				1:  {0},
-				2:  {1},
-				3:  {2},
-				4:  {2, 5, 11},
-				5:  {2, 11},
-				6:  {5},
-				7:  {5, 6, 13},
-				8:  {6},
-				9:  {6},
-				10: {8, 9},
-				11: {6},
-				12: {1},
-				13: {12},
-				14: {12},
-			},
 		},
 	}
 	for i, item := range items {
 		graph := newGraph()
 		for _, node := range item.nodes {
+			for graph.len() <= max(node.childId, node.parentId) {
+				graph.newNode(-1, nodeValue{})
+			}
 			graph.addNode(node.childId, node.parentId)
 		}
-		if !reflect.DeepEqual(graph.childs, item.childs) {
-			t.Errorf("Test #%d: actual graph children structure is incorrect: %#v", i+1, graph.childs)
+		childs := make(map[int][]int)
+		for nodeId := 0; nodeId < graph.len(); nodeId++ {
+			if len(graph.children(nodeId)) > 0 {
+				childs[nodeId] = graph.children(nodeId)
+			}
 		}
-		if !reflect.DeepEqual(graph.prnts, item.parents) {
-			t.Errorf("Test #%d: actual graph parents structure is incorrect: %#v", i+1, graph.prnts)
+		if !reflect.DeepEqual(childs, item.childs) {
+			t.Errorf("Test #%d: actual graph children structure is incorrect: %#v", i+1, childs)
 		}
 	}
 }
 
-func TestGraph_Renumber(t *testing.T) {
-	items := []struct {
-		nodes                      []node
-		childs                     map[int][]int
-		parents                    map[int][]int
-		currentNodeId, breakNodeId int
-	}{
-		// #1
-		{
-			[]node{
-				{1, 0},
-				{2, 1}, {6, 1},
-				{3, 2},
-				{4, 3},
-				{5, 4},
-			},
-			map[int][]int{
-				0: {1},
-				1: {2, 4},
-				2: {3},
-				3: {4},
-				4: {5},
-				5: {6},
-			},
-			map[int][]int{
-				1: {0},
-				2: {1},
-				3: {2},
-				4: {1, 3},
-				5: {4},
-				6: {5},
-			},
-			6, 4,
-		},
-		// #2
-		{
-			[]node{
-				{1, 0},
-				{2, 1}, {12, 1},
-				{3, 2}, {4, 2}, {5, 2},
-				{4, 5}, {6, 5}, {7, 5},
-				{7, 6}, {8, 6}, {9, 6}, {11, 6},
-				{2, 8}, {10, 8},
-				{10, 9},
-				{4, 11}, {5, 11},
-				{13, 12}, {14, 12},
-				{7, 13},
-			},
-			map[int][]int{
-				0:  {1},
-				1:  {2, 5},
-				2:  {3, 4, 7},
-				5:  {6, 7},
-				6:  {10},
-				7:  {8},
-				8:  {4, 9, 10},
-				9:  {10, 11, 12, 14},
-				11: {2, 13},
-				12: {13},
-				14: {4, 8},
-			},
-			map[int][]int{
-				1:  {0},
-				2:  {1, 11},
-				3:  {2},
-				4:  {2, 8, 14},
-				5:  {1},
-				6:  {5},
-				7:  {5, 2, 14},
-				8:  {7},
-				9:  {8},
-				10: {8, 9, 6},
-				11: {9},
-				12: {9},
-				13: {11, 12},
-				14: {9},
-			},
-			14, 5,
-		},
-		// #3
-		{
-			[]node{
-				{1, 0},
-				{2, 1}, {7, 1}, {10, 1},
-				{3, 2},
-				{4, 3},
-				{5, 4},
-				{6, 5},
-				{8, 7},
-				{9, 8},
-			},
-			map[int][]int{
-				0: {1},
-				1: {2, 5, 8},
-				2: {3},
-				3: {4},
-				4: {8},
-				5: {6},
-				6: {7},
-				8: {9},
-				9: {10},
-			},
-			map[int][]int{
-				1:  {0},
-				2:  {1},
-				3:  {2},
-				4:  {3},
-				5:  {1},
-				6:  {5},
-				7:  {6},
-				8:  {1, 4},
-				9:  {8},
-				10: {9},
-			},
-			10, 5,
-		},
+func TestGraph_Number(t *testing.T) {
+	// struct {P *int; S [2]int} where P points to S[1]:
+	// the pointer is traversed first and its element is taken over by the container of S[1]
+	g := newGraph()
+	root := g.newNode(-1, nodeValue{})
+	p := g.newContainer(root, nodeValue{})
+	ptr := g.newNode(p, nodeValue{})
+	elem := g.newNode(ptr, nodeValue{})
+	s := g.newContainer(root, nodeValue{})
+	arr := g.newNode(s, nodeValue{})
+	s0 := g.newContainer(arr, nodeValue{})
+	g.newNode(s0, nodeValue{})
+	s1 := g.newContainer(arr, nodeValue{})
+	g.takeOver(ptr, s1)
+	g.number()
+
+	// the element gets id after the container of S[1], while the pointer refers to the container
+	expected := []int{0, 1, 2, 8, 3, 4, 5, 6, 7}
+	var actual []int
+	for _, nodeId := range []int{root, p, ptr, elem, s, arr, s0, s0 + 1, s1} {
+		actual = append(actual, g.id(nodeId))
 	}
-	for i, item := range items {
-		graph := newGraph()
-		for _, node := range item.nodes {
-			graph.addNode(node.childId, node.parentId)
-		}
-		graph.renumber(item.currentNodeId, item.breakNodeId)
-		if !reflect.DeepEqual(graph.childs, item.childs) {
-			t.Errorf("Test #%d: actual graph children structure is incorrect: %#v", i+1, graph.childs)
-		}
-		if !reflect.DeepEqual(graph.prnts, item.parents) {
-			t.Errorf("Test #%d: actual graph parents structure is incorrect: %#v", i+1, graph.prnts)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("graph nodes are numbered incorrectly: %v, expected: %v", actual, expected)
+	}
+	if !reflect.DeepEqual(g.children(ptr), []int{s1}) || !reflect.DeepEqual(g.children(s1), []int{elem}) {
+		t.Errorf("element of the pointer must be moved to the container")
+	}
+}
+
+func TestGraph_BackPointers(t *testing.T) {
+	v := newTestGraphBackPointers(1000)
+	var actual *testGraphBackPointers
+	if err := NewUnserializer().DecodeInto(Serialize(v), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if len(actual.Items) != len(v.Items) {
+		t.Fatalf("decoded value has %d items instead of %d", len(actual.Items), len(v.Items))
+	}
+	for i, ptr := range actual.Ptrs {
+		if ptr != &actual.Items[i].A || actual.Items[i] != v.Items[i] {
+			t.Fatalf("pointer #%d must point to the field of the item", i)
 		}
 	}
 }
+
+type testGraphScalars struct {
+	P1  *int
+	Arr [3]int
+	N   int
+	P2  *int
+	P3  *int
+}
+
+func TestGraph_Scalars(t *testing.T) {
+	serializer := NewSerializer()
+	serializer.Encode(make([]int64, 1000))
+	if serializer.values.len() != 1 {
+		t.Errorf("scalar elements must have no nodes, but the graph has %d nodes", serializer.values.len())
+	}
+
+	// pointers to scalar elements and fields before and after them
+	v := &testGraphScalars{Arr: [3]int{1, 2, 3}, N: 4}
+	v.P1, v.P2, v.P3 = &v.Arr[1], &v.N, &v.Arr[1]
+	var actual *testGraphScalars
+	if err := NewUnserializer().DecodeInto(serializer.Encode(v), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if actual.Arr != v.Arr || actual.N != v.N {
+		t.Errorf("decoded value is incorrect: %+v", actual)
+	}
+	if actual.P1 != &actual.Arr[1] || actual.P2 != &actual.N || actual.P3 != actual.P1 {
+		t.Errorf("pointers must point to the element and the field of the decoded value")
+	}
+}
+
+type testGraphCopy struct {
+	X []testGraphCopy
+	N int
+}
+
+func TestGraph_PointerToElementCopy(t *testing.T) {
+	// the slice is reachable only through the element of the pointer to it,
+	// so the pointed element is encoded in place of the pointer and the slice holds its copy
+	sl := make([]testGraphCopy, 2)
+	sl[0].X = sl
+	sl[1].N = 1
+	var actual *testGraphCopy
+	if err := NewUnserializer().DecodeInto(Serialize(&sl[0]), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if len(actual.X) != 2 || actual.X[1].N != 1 {
+		t.Fatalf("decoded value is incorrect: %+v", actual)
+	}
+	if actual == &actual.X[0] {
+		t.Errorf("pointer must point to the copy of the element")
+	}
+	if &actual.X[0].X[0] != &actual.X[0] {
+		t.Errorf("slice of the copied element must be the decoded slice")
+	}
+}
+
+func newTestGraphBackPointers(count int) *testGraphBackPointers {
+	v := &testGraphBackPointers{
+		Ptrs:  make([]*int, count),
+		Items: make([]testGraphItem, count),
+	}
+	for i := range v.Items {
+		v.Items[i] = testGraphItem{A: i, B: -i}
+		v.Ptrs[i] = &v.Items[i].A
+	}
+	return v
+}
+
+// BenchmarkEncodeGraph encodes a graph of about 1M nodes without shared values
+func BenchmarkEncodeGraph(b *testing.B) {
+	v := make([]testGraphItem, 1<<20/7)
+	for i := range v {
+		v[i] = testGraphItem{A: i, B: -i}
+	}
+	serializer := NewSerializer()
+	var data []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data = serializer.AppendEncode(data[:0], v)
+	}
+}
+
+// BenchmarkEncodeGraphBackPointers encodes a graph of about 1M nodes where every struct
+// is preceded by a pointer to its field, so the pointed values are taken over by the fields
+func BenchmarkEncodeGraphBackPointers(b *testing.B) {
+	v := newTestGraphBackPointers(1 << 20 / 10)
+	serializer := NewSerializer()
+	var data []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data = serializer.AppendEncode(data[:0], v)
+	}
+}
@@ -4,3 +4,12 @@ type Serializable interface {
 	Serialize() []byte
 	Unserialize([]byte) (any, error)
 }
+
+// CodecMarshaler is implemented by types that encode their values as a sequence of values
+// through the encoder given to MarshalCodec and decode them in the same order from the decoder given to UnmarshalCodec.
+// The values are encoded by the same serializer as the rest of data, so references between them are preserved.
+// Methods can relate either to a type value or to pointer to the value, UnmarshalCodec is called on the decoded value itself.
+type CodecMarshaler interface {
+	MarshalCodec(e *Encoder) error
+	UnmarshalCodec(d *Decoder) error
+}
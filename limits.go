@@ -0,0 +1,52 @@
+package codec
+
+import "fmt"
+
+// Limits restricts resources that decoding of untrusted data can consume.
+// Zero value of a field means the limit of DefaultLimits, negative value means that there is no limit.
+type Limits struct {
+	MaxBytes        int // maximum size of encoded data
+	MaxLength       int // maximum length (and capacity) of strings, slices, maps and other collections
+	MaxChanCapacity int // maximum capacity of channels
+	MaxDepth        int // maximum nesting depth of values, it is not limited by default
+	MaxNodes        int // maximum number of decoded values (including struct fields and collection elements)
+}
+
+// DefaultLimits are applied to the limits that are not set. They keep decoding of any data
+// from exhausting memory, while the size of data, the number of values and the nesting depth are not limited,
+// since values encoded by Serialize (e.g. long linked lists) can be nested arbitrarily deep.
+var DefaultLimits = Limits{
+	MaxLength:       1 << 24,
+	MaxChanCapacity: 1 << 16,
+}
+
+// spareMemory is the memory that can be allocated for capacities of slices and channels
+// exceeding their lengths regardless of the data size, since the capacities are not backed by data
+const spareMemory = 1 << 20
+
+// withDefaults returns the limits with unset fields replaced by the default limits
+func (l Limits) withDefaults() Limits {
+	l.MaxBytes = limitOrDefault(l.MaxBytes, DefaultLimits.MaxBytes)
+	l.MaxLength = limitOrDefault(l.MaxLength, DefaultLimits.MaxLength)
+	l.MaxChanCapacity = limitOrDefault(l.MaxChanCapacity, DefaultLimits.MaxChanCapacity)
+	l.MaxDepth = limitOrDefault(l.MaxDepth, DefaultLimits.MaxDepth)
+	l.MaxNodes = limitOrDefault(l.MaxNodes, DefaultLimits.MaxNodes)
+	return l
+}
+
+func limitOrDefault(limit, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+func exceeds(value, limit int) bool {
+	return limit > 0 && value > limit
+}
+
+func checkLimit(name string, value, limit int) {
+	if exceeds(value, limit) {
+		panic(fmt.Errorf("%w: %s is %d, but maximum is %d", ErrLimitExceeded, name, value, limit))
+	}
+}
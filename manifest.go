@@ -0,0 +1,80 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// typeManifest is the persistent form of the type ids of a type registry
+type typeManifest struct {
+	NextId int            `json:"nextId"` // id of the next registered type
+	Types  map[string]int `json:"types"`  // type names and their ids
+	Funcs  map[string]int `json:"funcs"`  // function names and their ids
+}
+
+// WriteManifest writes ids of the registered types and functions as JSON,
+// so that the ids can be pinned across program runs with LoadTypeRegistry
+func (r *TypeRegistry) WriteManifest(w io.Writer) error {
+	m := typeManifest{
+		Types: make(map[string]int),
+		Funcs: make(map[string]int),
+	}
+	r.mx.RLock()
+	m.NextId = r.nextId
+	for name, id := range r.ids {
+		if r.funcNames[name] {
+			m.Funcs[name] = id
+		} else {
+			m.Types[name] = id
+		}
+	}
+	r.mx.RUnlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(m)
+}
+
+// LoadTypeRegistry creates a type registry with type ids pinned by the manifest written by WriteManifest.
+// The types and functions of the manifest are bound to their ids when they are registered (in any order)
+// or encountered, and new types get ids that are greater than any id ever assigned by the registry.
+// Base types are registered automatically.
+func LoadTypeRegistry(r io.Reader) (*TypeRegistry, error) {
+	var m typeManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid type manifest: %w", err)
+	}
+	reg := NewTypeRegistry(true)
+	names := make(map[int]string)
+	pin := func(name string, id int, isFunc bool) error {
+		if id <= 0 {
+			return fmt.Errorf("invalid type manifest: %s has invalid id %d", name, id)
+		}
+		if other, exists := names[id]; exists {
+			return fmt.Errorf("invalid type manifest: %s and %s have the same id %d", other, name, id)
+		}
+		if _, exists := reg.ids[name]; exists {
+			return fmt.Errorf("invalid type manifest: %s is both type and function", name)
+		}
+		names[id] = name
+		reg.ids[name] = id
+		if isFunc {
+			reg.funcNames[name] = true
+		}
+		reg.nextId = max(reg.nextId, id+1)
+		return nil
+	}
+	for name, id := range m.Types {
+		if err := pin(name, id, false); err != nil {
+			return nil, err
+		}
+	}
+	for name, id := range m.Funcs {
+		if err := pin(name, id, true); err != nil {
+			return nil, err
+		}
+	}
+	reg.nextId = max(reg.nextId, m.NextId)
+	reg.RegisterBaseTypes()
+	return reg, nil
+}
@@ -0,0 +1,266 @@
+package codec
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/URALINNOVATSIYA/reflex"
+)
+
+// encodeFunc encodes value v of node nodeId
+type encodeFunc func(s *Serializer, v reflect.Value, nodeId int)
+
+// decodeFunc decodes value of type t into v and returns the decoded value
+type decodeFunc func(u *Unserializer, t reflect.Type, v reflect.Value) reflect.Value
+
+// typePlan holds the decisions about coding of a type that do not depend on its values,
+// so they are made once per type registry instead of for every value
+type typePlan struct {
+	name        string       // full name of the type
+	id          atomic.Int32 // id of the type in the registry, zero until the type is bound to the id
+	marshaler   marshaler
+	codec       typeCodec    // codec of the registry, if the marshaler is registryCodec
+	fields      structFields // fields of struct types
+	scalar      bool         // values are encoded in place and cannot be shared (see Serializer.bindScalars)
+	scalarElems bool         // elements of the list type are scalar
+	encode      encodeFunc
+	decode      decodeFunc
+}
+
+// planOf returns the coding plan of type t compiling it at the first call
+func (r *TypeRegistry) planOf(t reflect.Type) *typePlan {
+	if p, exists := r.plans.Load(t); exists {
+		return p.(*typePlan)
+	}
+	p, _ := r.plans.LoadOrStore(t, r.compilePlan(t))
+	return p.(*typePlan)
+}
+
+// resetPlans discards the compiled plans, since a registered codec changes plans of its type
+func (r *TypeRegistry) resetPlans() {
+	r.plans.Range(func(t, _ any) bool {
+		r.plans.Delete(t)
+		return true
+	})
+}
+
+func (r *TypeRegistry) compilePlan(t reflect.Type) *typePlan {
+	p := &typePlan{
+		name:      reflex.NameOf(t),
+		marshaler: r.marshalerOf(t),
+	}
+	if p.marshaler == registryCodec {
+		p.codec, _ = r.codecOf(t)
+	}
+	p.scalar = r.isScalar(t)
+	if p.marshaler == noMarshaler {
+		switch t.Kind() {
+		case reflect.Struct:
+			p.fields = structFieldsOf(t)
+			for _, fields := range [][]structField{p.fields.fields, p.fields.named} {
+				for i := range fields {
+					fields[i].scalar = r.isScalar(t.Field(fields[i].index).Type)
+				}
+			}
+		case reflect.Slice, reflect.Array:
+			p.scalarElems = r.isScalar(t.Elem())
+		}
+	}
+	p.encode = encoderOf(t, p)
+	p.decode = decoderOf(t, p)
+	return p
+}
+
+// isScalar reports whether values of type t are encoded in place and cannot be shared
+func (r *TypeRegistry) isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return r.marshalerOf(t) == noMarshaler
+	default:
+		return false
+	}
+}
+
+func encoderOf(t reflect.Type, p *typePlan) encodeFunc {
+	if p.marshaler != noMarshaler {
+		return func(s *Serializer, v reflect.Value, nodeId int) {
+			s.encodeSerializable(p, v, nodeId)
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return valueEncoder((*Serializer).encodeBool)
+	case reflect.String:
+		return valueEncoder((*Serializer).encodeString)
+	case reflect.Uint8:
+		return valueEncoder((*Serializer).encodeUint8)
+	case reflect.Int8:
+		return valueEncoder((*Serializer).encodeInt8)
+	case reflect.Uint16:
+		return valueEncoder((*Serializer).encodeUint16)
+	case reflect.Int16:
+		return valueEncoder((*Serializer).encodeInt16)
+	case reflect.Uint32:
+		return valueEncoder((*Serializer).encodeUint32)
+	case reflect.Int32:
+		return valueEncoder((*Serializer).encodeInt32)
+	case reflect.Uint64:
+		return valueEncoder((*Serializer).encodeUint64)
+	case reflect.Int64:
+		return valueEncoder((*Serializer).encodeInt)
+	case reflect.Uint:
+		return valueEncoder((*Serializer).encodeUint)
+	case reflect.Int:
+		return valueEncoder((*Serializer).encodeInt)
+	case reflect.Float32:
+		return valueEncoder((*Serializer).encodeFloat32)
+	case reflect.Float64:
+		return valueEncoder((*Serializer).encodeFloat64)
+	case reflect.Complex64:
+		return valueEncoder((*Serializer).encodeComplex64)
+	case reflect.Complex128:
+		return valueEncoder((*Serializer).encodeComplex128)
+	case reflect.Uintptr:
+		return valueEncoder((*Serializer).encodeUintptr)
+	case reflect.UnsafePointer:
+		return valueEncoder((*Serializer).encodeUnsafePointer)
+	case reflect.Chan:
+		return valueEncoder((*Serializer).encodeChan)
+	case reflect.Func:
+		return valueEncoder((*Serializer).encodeFunc)
+	case reflect.Array:
+		return func(s *Serializer, v reflect.Value, nodeId int) {
+			s.encodeArray(p, v, nodeId)
+		}
+	case reflect.Slice:
+		return func(s *Serializer, v reflect.Value, nodeId int) {
+			s.encodeSlice(p, v, nodeId)
+		}
+	case reflect.Map:
+		return (*Serializer).encodeMap
+	case reflect.Struct:
+		return func(s *Serializer, v reflect.Value, nodeId int) {
+			s.encodeStruct(p.fields, v, nodeId)
+		}
+	case reflect.Interface:
+		return nodeEncoder((*Serializer).encodeInterface)
+	case reflect.Pointer:
+		return nodeEncoder((*Serializer).encodePointer)
+	default:
+		panic("unrecognized value kind")
+	}
+}
+
+func valueEncoder(encode func(s *Serializer, v reflect.Value)) encodeFunc {
+	return func(s *Serializer, v reflect.Value, _ int) {
+		encode(s, v)
+	}
+}
+
+func nodeEncoder(encode func(s *Serializer, nodeId int)) encodeFunc {
+	return func(s *Serializer, _ reflect.Value, nodeId int) {
+		encode(s, nodeId)
+	}
+}
+
+func decoderOf(t reflect.Type, p *typePlan) decodeFunc {
+	if p.marshaler != noMarshaler {
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodeSerializable(p, t, v)
+		})
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return valueDecoder((*Unserializer).decodeBool)
+	case reflect.Uint8:
+		return valueDecoder((*Unserializer).decodeUint8)
+	case reflect.Int8:
+		return valueDecoder((*Unserializer).decodeInt8)
+	case reflect.Uint16:
+		return valueDecoder((*Unserializer).decodeUint16)
+	case reflect.Int16:
+		return valueDecoder((*Unserializer).decodeInt16)
+	case reflect.Uint32:
+		return valueDecoder((*Unserializer).decodeUint32)
+	case reflect.Int32:
+		return valueDecoder((*Unserializer).decodeInt32)
+	case reflect.Uint64:
+		return valueDecoder((*Unserializer).decodeUint64)
+	case reflect.Int64:
+		return valueDecoder((*Unserializer).decodeInt64)
+	case reflect.Uint:
+		return valueDecoder((*Unserializer).decodeUint)
+	case reflect.Int:
+		return valueDecoder((*Unserializer).decodeInt)
+	case reflect.Float32:
+		return valueDecoder((*Unserializer).decodeFloat32)
+	case reflect.Float64:
+		return valueDecoder((*Unserializer).decodeFloat64)
+	case reflect.Complex64:
+		return valueDecoder((*Unserializer).decodeComplex64)
+	case reflect.Complex128:
+		return valueDecoder((*Unserializer).decodeComplex128)
+	case reflect.Uintptr:
+		return valueDecoder((*Unserializer).decodeUintptr)
+	case reflect.UnsafePointer:
+		return valueDecoder((*Unserializer).decodeUnsafePointer)
+	case reflect.String:
+		return referenceDecoder((*Unserializer).decodeString)
+	case reflect.Chan:
+		return referenceDecoder((*Unserializer).decodeChan)
+	case reflect.Func:
+		return referenceDecoder((*Unserializer).decodeFunc)
+	case reflect.Array:
+		elemType := t.Elem()
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodeArray(elemType, v)
+		})
+	case reflect.Slice:
+		elemType := t.Elem()
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodeList(elemType, v)
+		})
+	case reflect.Map:
+		keyType, valueType := t.Key(), t.Elem()
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodeMap(keyType, valueType, v)
+		})
+	case reflect.Struct:
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodeStruct(p.fields, v)
+		})
+	case reflect.Interface:
+		return referenceDecoder((*Unserializer).decodeInterface)
+	case reflect.Pointer:
+		elemType := t.Elem()
+		return referenceDecoder(func(u *Unserializer, v reflect.Value) {
+			u.decodePointer(elemType, v)
+		})
+	default:
+		panic("unrecognized value kind")
+	}
+}
+
+// valueDecoder returns decodeFunc of values that cannot be referenced
+func valueDecoder(decode func(u *Unserializer, v reflect.Value)) decodeFunc {
+	return func(u *Unserializer, _ reflect.Type, v reflect.Value) reflect.Value {
+		decode(u, v)
+		u.id++
+		return v
+	}
+}
+
+// referenceDecoder returns decodeFunc of values that can be encoded as references to other values
+func referenceDecoder(decode func(u *Unserializer, v reflect.Value)) decodeFunc {
+	return func(u *Unserializer, t reflect.Type, v reflect.Value) reflect.Value {
+		if u.top() == meta_ref {
+			return u.decodeReference(t, v)
+		}
+		u.values[u.id] = v
+		u.id++
+		decode(u, v)
+		return v
+	}
+}
@@ -1,33 +1,130 @@
 package codec
 
 import (
+	"encoding"
+	"encoding/gob"
 	"reflect"
+	"unsafe"
+
+	"github.com/URALINNOVATSIYA/reflex"
 )
 
-var serializableInterfaceType = reflect.TypeOf((*Serializable)(nil)).Elem()
+var (
+	serializableInterfaceType      = reflect.TypeOf((*Serializable)(nil)).Elem()
+	codecMarshalerInterfaceType    = reflect.TypeOf((*CodecMarshaler)(nil)).Elem()
+	binaryMarshalerInterfaceType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerInterfaceType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	gobEncoderInterfaceType        = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	gobDecoderInterfaceType        = reflect.TypeOf((*gob.GobDecoder)(nil)).Elem()
+	anyType                        = reflect.TypeOf((*any)(nil)).Elem()
+	anySliceType                   = reflect.TypeOf([]any(nil))
+)
 
-func isSerializable(v reflect.Value) bool {
-	if v.IsValid() {
-		t := v.Type()
-		if isPointer(t) {
-			if isCommonType(t.Elem()) {
-				return false
-			}
-		} else if isCommonType(t) {
+// valuePtr returns the data pointer of v, which is the address of the value if it is stored indirectly.
+// Addresses of addressable values are read through reflect, which does not allocate unlike reflex.PtrOf.
+func valuePtr(v reflect.Value) unsafe.Pointer {
+	if v.CanAddr() {
+		return unsafe.Pointer(v.UnsafeAddr())
+	}
+	return reflex.PtrOf(v)
+}
+
+// valueDirPtr returns the pointer held by v of a pointer-like kind (the same as reflex.DirPtrOf)
+func valueDirPtr(v reflect.Value) unsafe.Pointer {
+	switch v.Kind() {
+	case reflect.String:
+		return unsafe.Pointer(unsafe.StringData(v.String()))
+	case reflect.Func:
+		// reflect returns the code pointer of a function, which is shared by closures
+		return reflex.DirPtrOf(v)
+	default:
+		return v.UnsafePointer()
+	}
+}
+
+// marshaler is the interface through which values of a type are encoded as a whole
+type marshaler byte
+
+const (
+	noMarshaler   marshaler = iota
+	registryCodec           // codec registered in the type registry
+	serializableMarshaler
+	codecMarshaler  // CodecMarshaler, its values are encoded as a list of the values written by MarshalCodec
+	binaryMarshaler // encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+	gobMarshaler    // gob.GobEncoder and gob.GobDecoder
+)
+
+// isSerializableType reports whether values of type t are encoded as a whole through a marshaler
+func isSerializableType(t reflect.Type) bool {
+	return marshalerOf(t) != noMarshaler
+}
+
+// marshalerOf returns the marshaler of type t: either t or pointer to t must implement Serializable, CodecMarshaler
+// or both methods of encoding.BinaryMarshaler and encoding.BinaryUnmarshaler (gob.GobEncoder and gob.GobDecoder),
+// the unmarshaling method must be implemented by pointer to t. Pointers to such types are encoded as usual pointers.
+// Binary and gob methods promoted from embedded fields are ignored, since they encode only the embedded value.
+func marshalerOf(t reflect.Type) marshaler {
+	if t == nil || isPointer(t) || t.Kind() == reflect.Interface || isCommonType(t) {
+		return noMarshaler
+	}
+	ptr := reflect.PointerTo(t)
+	switch {
+	case ptr.Implements(serializableInterfaceType):
+		return serializableMarshaler
+	case ptr.Implements(codecMarshalerInterfaceType):
+		return codecMarshaler
+	case implementsOwn(t, binaryMarshalerInterfaceType, binaryUnmarshalerInterfaceType):
+		return binaryMarshaler
+	case implementsOwn(t, gobEncoderInterfaceType, gobDecoderInterfaceType):
+		return gobMarshaler
+	default:
+		return noMarshaler
+	}
+}
+
+// implementsOwn reports whether pointer to t implements the interfaces and none of their methods
+// is promoted from an embedded field of t
+func implementsOwn(t reflect.Type, interfaces ...reflect.Type) bool {
+	ptr := reflect.PointerTo(t)
+	for _, i := range interfaces {
+		if !ptr.Implements(i) {
 			return false
 		}
-		return t.Implements(serializableInterfaceType)
 	}
-	return false
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() != reflect.Pointer && ft.Kind() != reflect.Interface {
+			ft = reflect.PointerTo(ft)
+		}
+		for _, i := range interfaces {
+			for m := 0; m < i.NumMethod(); m++ {
+				if _, exists := ft.MethodByName(i.Method(m).Name); exists {
+					return false
+				}
+			}
+		}
+	}
+	return true
 }
 
 func isNil(v reflect.Value) bool {
-	switch v.Kind() {
+	return v.IsValid() && isNillable(v.Type()) && v.IsNil()
+}
+
+func isNillable(t reflect.Type) bool {
+	switch t.Kind() {
 	case reflect.Interface,
 		reflect.Map, reflect.Slice,
 		reflect.Pointer, reflect.UnsafePointer,
 		reflect.Chan, reflect.Func:
-		return v.IsNil()
+		return true
 	default:
 		return false
 	}
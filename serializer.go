@@ -1,15 +1,23 @@
 package codec
 
 import (
+	"encoding"
+	"encoding/gob"
 	"fmt"
+	"io"
 	"math"
 	"math/bits"
 	"reflect"
+	"slices"
 	"unsafe"
 
 	"github.com/URALINNOVATSIYA/reflex"
 )
 
+const version byte = 0b0000_0010 // version of the encoding format
+
+const typeNames byte = 0b1000_0000 // flag of the version byte: type names follow the first occurrences of type ids
+
 const (
 	meta_ref   byte = 0b0000_0000 // pseudo type for referenced values
 	meta_fls   byte = 0b0000_0001 // boolean false
@@ -20,10 +28,26 @@ const (
 )
 
 type Serializer struct {
-	typeRegistry *TypeRegistry
-	values       *graph
-	nodeId       int
-}
+	typeRegistry     *TypeRegistry
+	structCodingMode StructCodingMode
+	typeIdMode       TypeIdMode
+	namedTypes       map[int]bool // ids of the types which names are already encoded
+	values           *graph
+	buf              []byte    // encoded data, when w is set it is the part not yet written to w
+	w                io.Writer // destination of the streamed data, nil if the data is appended to buf
+	stream           []byte    // buffer reused by the streaming encoding
+	flushed          int       // number of bytes flushed (or discarded while measuring) since the start of the value
+	fieldSizes       []int     // sizes of the fields encoded in name mode measured before the streaming encoding
+	nextField        int       // index of the size of the next field in fieldSizes
+	measuring        bool      // the value is encoded only to measure fieldSizes, the data is discarded
+}
+
+// fieldSizeLength is the length of the encoded size of the field in name mode. The size is padded
+// to the fixed length, so the slot reserved for it is written in place once the field is encoded.
+const fieldSizeLength = 5
+
+// flushSize is the number of buffered bytes of the streaming encoding that are written to the destination at once
+const flushSize = 4096
 
 func NewSerializer() *Serializer {
 	return &Serializer{
@@ -32,14 +56,29 @@ func NewSerializer() *Serializer {
 }
 
 func (s *Serializer) WithOptions(options []any) *Serializer {
+	if err := s.applyOptions(options); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// applyOptions configures the serializer with the options, it returns an error if an option is not supported
+func (s *Serializer) applyOptions(options []any) error {
 	for _, option := range options {
-		if v, ok := option.(*TypeRegistry); ok {
+		switch v := option.(type) {
+		case *TypeRegistry:
 			s.WithTypeRegistry(v)
-			continue
+		case StructCodingMode:
+			s.WithStructCodingMode(v)
+		case TypeIdMode:
+			s.WithTypeIdMode(v)
+		case Limits:
+			// limits apply only to decoding
+		default:
+			return fmt.Errorf("invalid option type %T", option)
 		}
-		panic(fmt.Errorf("invalid option type %T", option))
 	}
-	return s
+	return nil
 }
 
 func (s *Serializer) WithTypeRegistry(registry *TypeRegistry) *Serializer {
@@ -47,33 +86,117 @@ func (s *Serializer) WithTypeRegistry(registry *TypeRegistry) *Serializer {
 	return s
 }
 
-func (s *Serializer) Encode(v any) []byte {
-	s.nodeId = 0
-	s.values = newGraph()
-	bytes := s.encode(reflect.ValueOf(v))
-	return append([]byte{version}, bytes...)
+func (s *Serializer) WithStructCodingMode(mode StructCodingMode) *Serializer {
+	s.structCodingMode = mode
+	return s
 }
 
-func (s *Serializer) encode(v reflect.Value) []byte {
-	s.traverse(-1, v)
-	b := s.encodeNodes()
-	return b
+func (s *Serializer) WithTypeIdMode(mode TypeIdMode) *Serializer {
+	s.typeIdMode = mode
+	return s
+}
+
+func (s *Serializer) Encode(v any) []byte {
+	return s.AppendEncode(nil, v)
+}
+
+// AppendEncode appends the encoded value v to dst and returns the extended buffer.
+// The data is written directly into dst, so reusing the returned buffer for the next values
+// avoids the allocation of the encoded data. The serializer reuses the memory of its value graph as well,
+// so values of the same shape are encoded without allocations, except copies of map keys and values
+// and the data of marshalers.
+func (s *Serializer) AppendEncode(dst []byte, v any) []byte {
+	s.buf, s.w = dst, nil
+	defer func() {
+		s.buf = nil
+	}()
+	s.encode(v)
+	return s.buf
+}
+
+// TryEncode is the same as Encode, but returns an error instead of panicking,
+// e.g. when a type is not registered and type auto registration is turned off
+func (s *Serializer) TryEncode(v any) (data []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			data, err = nil, errorOf(e)
+		}
+	}()
+	return s.Encode(v), nil
+}
+
+// encodeTo writes encoded value v to w by chunks of flushSize bytes
+func (s *Serializer) encodeTo(w io.Writer, v any) {
+	s.buf, s.w = s.stream[:0], w
+	defer func() {
+		s.stream = s.buf[:0]
+		s.buf, s.w = nil, nil
+	}()
+	s.encode(v)
+	s.flush()
+}
+
+// encode writes version of the encoding and encoded value v
+func (s *Serializer) encode(v any) {
+	if s.values == nil {
+		s.values = newGraph()
+	} else {
+		s.values.reset()
+	}
+	s.traverse(-1, reflect.ValueOf(v))
+	if s.values.scalarPtrs > 0 {
+		s.bindScalars()
+	}
+	s.values.number()
+	if s.w != nil && s.structCodingMode == StructCodingModeName {
+		s.measureFields()
+	}
+	s.flushed = 0
+	s.encodeData()
+}
+
+// encodeData writes version of the encoding and the encoded nodes of the graph
+func (s *Serializer) encodeData() {
+	if s.typeIdMode == TypeIdModeName {
+		s.namedTypes = make(map[int]bool)
+		s.writeByte(version | typeNames)
+	} else {
+		s.namedTypes = nil
+		s.writeByte(version)
+	}
+	s.encodeNodes()
 }
 
-func (s *Serializer) nextNodeId() int {
-	id := s.nodeId
-	s.nodeId++
-	return id
+// measureFields encodes the value discarding the data to find sizes of the fields encoded in name mode,
+// so that the streaming encoding writes the sizes before the fields without buffering them
+func (s *Serializer) measureFields() {
+	s.fieldSizes, s.nextField = s.fieldSizes[:0], 0
+	s.measuring, s.flushed = true, 0
+	defer func() {
+		s.measuring = false
+	}()
+	s.encodeData()
+	s.buf = s.buf[:0]
+	s.values.unvisit()
 }
 
 func (s *Serializer) address(v reflect.Value) valueAddr {
-	if ptr := s.ptrOf(v); ptr != nil {
-		return valueAddr{
-			ptr,
-			reflex.NameOf(v.Type()),
-		}
+	ptr := s.ptrOf(v)
+	if ptr == nil {
+		return valueAddr{}
+	}
+	addr := valueAddr{
+		ptr: ptr,
+		typ: v.Type(),
 	}
-	return valueAddr{}
+	switch v.Kind() {
+	case reflect.String:
+		addr.length = v.Len()
+	case reflect.Slice:
+		addr.length = v.Len()
+		addr.capacity = v.Cap()
+	}
+	return addr
 }
 
 func (s *Serializer) ptrOf(v reflect.Value) unsafe.Pointer {
@@ -82,60 +205,75 @@ func (s *Serializer) ptrOf(v reflect.Value) unsafe.Pointer {
 	}
 	switch v.Kind() {
 	case reflect.Struct, reflect.Array:
-		return reflex.PtrOf(v)
+		return valuePtr(v)
 	case reflect.String, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func, reflect.Pointer:
-		return reflex.DirPtrOf(v)
+		return valueDirPtr(v)
 	default:
 		return nil
 	}
 }
 
-func (s *Serializer) registerContainer(v reflect.Value, nodeId, parentNodeId int) bool {
+// registerContainer adds the container node of the element or field v and reports whether v is to be traversed
+func (s *Serializer) registerContainer(v reflect.Value, parentNodeId int) (int, bool) {
 	addr := valueAddr{
-		reflex.PtrOf(v),
-		reflex.NameOf(v.Type()),
+		ptr: valuePtr(v),
+		typ: v.Type(),
 	}
 	if containerId, exists := s.values.containerNodeAt(addr); exists {
-		s.values.addNodeWithValue(nodeId, parentNodeId, nodeValue{v: v, cntr: addr})
-		s.values.renumber(nodeId, containerId+1)
-		s.values.visit(s.values.children(containerId)[0])
-		return false
+		if s.values.isContainer(containerId) || s.values.isOpen(containerId) {
+			// the same memory is already registered as a container (elements of slices
+			// sharing the underlying array, zero-size elements) or the container is reachable
+			// only through the element of the pointer to it, so the value is a copy
+			return s.values.newContainer(parentNodeId, nodeValue{}), true
+		}
+		// the value is already traversed as the element of a pointer
+		nodeId := s.values.newContainer(parentNodeId, nodeValue{v: v, cntr: addr})
+		s.values.takeOver(containerId, nodeId)
+		return nodeId, false
 	}
-	s.values.addNodeWithValue(nodeId, parentNodeId, nodeValue{cntr: addr})
-	return true
+	return s.values.newContainer(parentNodeId, nodeValue{cntr: addr}), true
 }
 
 func (s *Serializer) registerValue(v reflect.Value, parentNodeId int) int {
 	addr := s.address(v)
 	if !addr.isValid() {
-		nodeId := s.nextNodeId()
-		s.values.addNodeWithValue(nodeId, parentNodeId, nodeValue{v: v})
-		return nodeId
+		return s.values.newNode(parentNodeId, nodeValue{v: v})
 	}
 	if nodeId, exists := s.values.nodeAt(addr); exists {
 		s.values.addNode(nodeId, parentNodeId)
 		return -1
 	}
-	nodeId := s.nextNodeId()
-	s.values.addNodeWithValue(nodeId, parentNodeId, nodeValue{
+	return s.values.newNode(parentNodeId, nodeValue{
 		v:    v,
 		addr: addr,
 	})
-	return nodeId
 }
 
 func (s *Serializer) traverse(parentId int, v reflect.Value) {
 	nodeId := s.registerValue(v, parentId)
-	if nodeId < 0 {
+	if nodeId < 0 || !v.IsValid() {
+		return
+	}
+	p := s.typeRegistry.planOf(v.Type())
+	switch p.marshaler {
+	case noMarshaler:
+	case codecMarshaler:
+		s.traverseCodecMarshaler(v, nodeId)
+		return
+	default: // marshaled values are encoded as a whole
 		return
 	}
 	switch v.Kind() {
 	case reflect.Slice, reflect.Array:
-		s.traverseList(v, nodeId)
+		if p.scalarElems {
+			s.values.setScalarElems(nodeId) // scalar elements are encoded in place without traversal
+		} else {
+			s.traverseList(v, nodeId)
+		}
 	case reflect.Map:
 		s.traverseMap(v, nodeId)
 	case reflect.Struct:
-		s.traverseStruct(v, nodeId)
+		s.traverseStruct(v, p.fields, nodeId)
 	case reflect.Interface:
 		s.traverseInterface(v, nodeId)
 	case reflect.Pointer:
@@ -143,35 +281,36 @@ func (s *Serializer) traverse(parentId int, v reflect.Value) {
 	}
 }
 
-func (s *Serializer) traverseList(v reflect.Value, id int) {
-	/*length := v.Len()
-	itemId := s.nextId
-	s.nextId += length
-	for i := 0; i < length; i++ {
+func (s *Serializer) traverseList(v reflect.Value, nodeId int) {
+	for i, length := 0, v.Len(); i < length; i++ {
 		elem := v.Index(i)
-		s.registerContainer(elem, itemId, id)
-		s.traverse(id, elem)
-		itemId++
-	}*/
+		if elemId, ok := s.registerContainer(elem, nodeId); ok {
+			s.traverse(elemId, elem)
+		}
+	}
 }
 
-func (s *Serializer) traverseMap(v reflect.Value, id int) {
+func (s *Serializer) traverseMap(v reflect.Value, nodeId int) {
 	iter := v.MapRange()
 	for iter.Next() {
-		s.traverse(id, iter.Key())
-		s.traverse(id, iter.Value())
+		s.traverse(nodeId, iter.Key())
+		s.traverse(nodeId, iter.Value())
 	}
 }
 
-func (s *Serializer) traverseStruct(v reflect.Value, nodeId int) {
-	fieldCount := v.NumField()
-	for i := 0; i < fieldCount; i++ {
-		field := v.Field(i)
-		fieldId := s.nextNodeId()
-		if s.registerContainer(field, fieldId, nodeId) {
+func (s *Serializer) traverseStruct(v reflect.Value, fields structFields, nodeId int) {
+	for _, f := range fields.encodedFields(s.structCodingMode) {
+		field := v.Field(f.index)
+		if f.scalar {
+			s.values.addNode(scalarNode, nodeId)
+			continue
+		}
+		if f.isSuperseded() {
+			field = reflex.Zero(field.Type())
+		}
+		if fieldId, ok := s.registerContainer(field, nodeId); ok {
 			s.traverse(fieldId, field)
 		}
-		fieldId++
 	}
 }
 
@@ -185,274 +324,458 @@ func (s *Serializer) traversePointer(v reflect.Value, nodeId int) {
 	}
 	elem := v.Elem()
 	addr := valueAddr{
-		reflex.DirPtrOf(v),
-		reflex.NameOf(elem.Type()),
+		ptr: valueDirPtr(v),
+		typ: elem.Type(),
 	}
 	if containerId, exists := s.values.containerNodeAt(addr); exists {
-		s.values.addNodeValue(nodeId, nodeValue{v: v})
 		s.values.addNode(containerId, nodeId)
 		return
 	}
-	s.values.updateNodeValue(nodeId, s.values.nodeValue(nodeId), nodeValue{cntr: addr})
+	if s.typeRegistry.planOf(elem.Type()).scalar {
+		s.values.scalarPtrs++
+	}
+	s.values.addContainerAddr(nodeId, addr)
+	s.values.setOpen(nodeId, true)
 	s.traverse(nodeId, elem)
+	s.values.setOpen(nodeId, false)
+}
+
+// traverseCodecMarshaler traverses the values written by MarshalCodec as a slice of interfaces
+func (s *Serializer) traverseCodecMarshaler(v reflect.Value, nodeId int) {
+	e := &Encoder{nested: true}
+	if err := marshalerValue(v, codecMarshalerInterfaceType).(CodecMarshaler).MarshalCodec(e); err != nil {
+		panic(fmt.Errorf("cannot marshal value of type %s: %w", v.Type(), err))
+	}
+	s.traverse(nodeId, reflect.ValueOf(e.values))
+}
+
+// bindScalars adds the containers of scalar elements and fields which pointers refer to.
+// The containers are added after the traversal, since they are found by scanning the lists
+// and the structs with scalar elements and fields, which have no nodes of the containers.
+func (s *Serializer) bindScalars() {
+	for nodeId, count := 0, s.values.len(); nodeId < count; nodeId++ {
+		v := s.values.get(nodeId)
+		if s.values.hasScalarElems(nodeId) {
+			for i, length := 0, v.Len(); i < length; i++ {
+				s.bindScalar(v.Index(i), nodeId, i)
+			}
+			continue
+		}
+		for i, childId := range s.values.children(nodeId) {
+			if childId != scalarNode {
+				continue
+			}
+			f := s.typeRegistry.planOf(v.Type()).fields.encodedFields(s.structCodingMode)[i]
+			if !f.isSuperseded() {
+				s.bindScalar(v.Field(f.index), nodeId, i)
+			}
+		}
+	}
+}
+
+// bindScalar adds the container of scalar element or field v if a pointer refers to it
+func (s *Serializer) bindScalar(v reflect.Value, parentNodeId, position int) {
+	addr := valueAddr{
+		ptr: valuePtr(v),
+		typ: v.Type(),
+	}
+	// the memory can also be registered as the container of another list sharing the elements
+	if ptrId, exists := s.values.containerNodeAt(addr); exists && !s.values.isContainer(ptrId) {
+		s.values.newScalarContainer(parentNodeId, position, ptrId, nodeValue{cntr: addr})
+	}
 }
 
-func (s *Serializer) encodeNodes() []byte {
-	return s.encodeNode(s.values.children(-1)[0])
+func (s *Serializer) encodeNodes() {
+	s.encodeNode(0) // the root node
 }
 
-func (s *Serializer) encodeNode(nodeId int) []byte {
+func (s *Serializer) encodeNode(nodeId int) {
 	v := s.values.get(nodeId)
 	if s.values.isVisited(nodeId) {
-		return s.encodeReference(nodeId)
+		s.encodeReference(nodeId)
+		return
 	}
 	s.values.visit(nodeId)
-	return append(s.encodeType(v), s.encodeValue(v, nodeId)...)
+	s.encodeType(v)
+	s.encodeValue(v, nodeId)
 }
 
-func (s *Serializer) encodeContainer(containerId int) []byte {
+func (s *Serializer) encodeContainer(containerId int) {
 	nodeId := s.values.children(containerId)[0]
 	v := s.values.get(nodeId)
-	return s.visitValue(v, nodeId)
+	s.visitValue(v, nodeId)
 }
 
-func (s *Serializer) encodeType(v reflect.Value) []byte {
-	return u2bs(uint64(s.typeRegistry.typeIdByValue(v)), 3)
+func (s *Serializer) encodeType(v reflect.Value) {
+	id := s.typeRegistry.typeIdByValue(v)
+	s.writeUint(uint64(id), 3)
+	if s.namedTypes != nil && !s.namedTypes[id] {
+		s.namedTypes[id] = true
+		name := typeNameOf(v)
+		s.writeCount(len(name))
+		s.writeString(name)
+	}
 }
 
-func (s *Serializer) visitValue(v reflect.Value, nodeId int) []byte {
+func (s *Serializer) visitValue(v reflect.Value, nodeId int) {
 	if s.values.isVisited(nodeId) {
-		return s.encodeReference(nodeId)
+		s.encodeReference(nodeId)
+		return
 	}
 	s.values.visit(nodeId)
-	return s.encodeValue(v, nodeId)
+	s.encodeValue(v, nodeId)
 }
 
-func (s *Serializer) encodeValue(v reflect.Value, nodeId int) []byte {
-	switch v.Kind() {
-	case reflect.Invalid:
-		return s.encodeNil()
-	case reflect.Bool:
-		return s.encodeBool(v)
-	case reflect.String:
-		return s.encodeString(v)
-	case reflect.Uint8:
-		return s.encodeUint8(v)
-	case reflect.Int8:
-		return s.encodeInt8(v)
-	case reflect.Uint16:
-		return s.encodeUint16(v)
-	case reflect.Int16:
-		return s.encodeInt16(v)
-	case reflect.Uint32:
-		return s.encodeUint32(v)
-	case reflect.Int32:
-		return s.encodeInt32(v)
-	case reflect.Uint64:
-		return s.encodeUint64(v)
-	case reflect.Int64:
-		return s.encodeInt(v)
-	case reflect.Uint:
-		return s.encodeUint(v)
-	case reflect.Int:
-		return s.encodeInt(v)
-	case reflect.Float32:
-		return s.encodeFloat32(v)
-	case reflect.Float64:
-		return s.encodeFloat64(v)
-	case reflect.Complex64:
-		return s.encodeComplex64(v)
-	case reflect.Complex128:
-		return s.encodeComplex128(v)
-	case reflect.Uintptr:
-		return s.encodeUintptr(v)
-	case reflect.UnsafePointer:
-		return s.encodeUnsafePointer(v)
-	case reflect.Chan:
-		return s.encodeChan(v)
-	case reflect.Func:
-		return s.encodeFunc(v)
-	case reflect.Array:
-		return s.encodeArray(nodeId)
-	case reflect.Slice:
-		return s.encodeSlice(nodeId)
-	case reflect.Map:
-		return s.encodeMap(v, nodeId)
-	case reflect.Struct:
-		return s.encodeStruct(nodeId)
-	case reflect.Interface:
-		return s.encodeInterface(nodeId)
-	case reflect.Pointer:
-		return s.encodePointer(nodeId)
+func (s *Serializer) encodeValue(v reflect.Value, nodeId int) {
+	if !v.IsValid() {
+		s.encodeNil()
+		return
 	}
-	panic("unrecognized value kind")
+	s.typeRegistry.planOf(v.Type()).encode(s, v, nodeId)
+	s.flushFull()
 }
 
-func (s *Serializer) encodeNil() []byte {
-	return []byte{meta_nil}
+func (s *Serializer) encodeNil() {
+	s.writeByte(meta_nil)
 }
 
-func (s *Serializer) encodeBool(v reflect.Value) []byte {
+func (s *Serializer) encodeBool(v reflect.Value) {
 	if v.Bool() {
-		return []byte{meta_tru}
+		s.writeByte(meta_tru)
+	} else {
+		s.writeByte(meta_fls)
 	}
-	return []byte{meta_fls}
 }
 
-func (s *Serializer) encodeString(v reflect.Value) []byte {
-	return append(c2b(v.Len()), v.String()...)
+func (s *Serializer) encodeString(v reflect.Value) {
+	s.writeCount(v.Len())
+	s.writeString(v.String())
 }
 
-func (s *Serializer) encodeUint8(v reflect.Value) []byte {
-	return []byte{uint8(v.Uint())}
+func (s *Serializer) encodeUint8(v reflect.Value) {
+	s.writeByte(uint8(v.Uint()))
 }
 
-func (s *Serializer) encodeInt8(v reflect.Value) []byte {
-	return []byte{uint8(i2u(v.Int()))}
+func (s *Serializer) encodeInt8(v reflect.Value) {
+	s.writeByte(uint8(i2u(v.Int())))
 }
 
-func (s *Serializer) encodeUint16(v reflect.Value) []byte {
-	return u2bs(v.Uint(), 2)
+func (s *Serializer) encodeUint16(v reflect.Value) {
+	s.writeUint(v.Uint(), 2)
 }
 
-func (s *Serializer) encodeInt16(v reflect.Value) []byte {
-	return u2bs(i2u(v.Int()), 2)
+func (s *Serializer) encodeInt16(v reflect.Value) {
+	s.writeUint(i2u(v.Int()), 2)
 }
 
-func (s *Serializer) encodeUint32(v reflect.Value) []byte {
-	return u2bs(v.Uint(), 3)
+func (s *Serializer) encodeUint32(v reflect.Value) {
+	s.writeUint(v.Uint(), 3)
 }
 
-func (s *Serializer) encodeInt32(v reflect.Value) []byte {
-	return u2bs(i2u(v.Int()), 3)
+func (s *Serializer) encodeInt32(v reflect.Value) {
+	s.writeUint(i2u(v.Int()), 3)
 }
 
-func (s *Serializer) encodeUint64(v reflect.Value) []byte {
-	return u2bs(v.Uint(), 4)
+func (s *Serializer) encodeUint64(v reflect.Value) {
+	s.writeUint(v.Uint(), 4)
 }
 
-func (s *Serializer) encodeInt64(v reflect.Value) []byte {
-	return u2bs(i2u(v.Int()), 4)
+func (s *Serializer) encodeInt64(v reflect.Value) {
+	s.writeUint(i2u(v.Int()), 4)
 }
 
-func (s *Serializer) encodeUint(v reflect.Value) []byte {
-	return s.encodeUint64(v)
+func (s *Serializer) encodeUint(v reflect.Value) {
+	s.encodeUint64(v)
 }
 
-func (s *Serializer) encodeInt(v reflect.Value) []byte {
-	return s.encodeInt64(v)
+func (s *Serializer) encodeInt(v reflect.Value) {
+	s.encodeInt64(v)
 }
 
-func (s *Serializer) encodeFloat32(v reflect.Value) []byte {
-	return u2bs(uint64(bits.ReverseBytes32(math.Float32bits(float32(v.Float())))), 3)
+func (s *Serializer) encodeFloat32(v reflect.Value) {
+	s.writeUint(uint64(bits.ReverseBytes32(math.Float32bits(float32(v.Float())))), 3)
 }
 
-func (s *Serializer) encodeFloat64(v reflect.Value) []byte {
-	return u2bs(bits.ReverseBytes64(math.Float64bits(v.Float())), 4)
+func (s *Serializer) encodeFloat64(v reflect.Value) {
+	s.writeUint(bits.ReverseBytes64(math.Float64bits(v.Float())), 4)
 }
 
-func (s *Serializer) encodeComplex64(v reflect.Value) []byte {
+func (s *Serializer) encodeComplex64(v reflect.Value) {
 	c := v.Complex()
-	r := s.encodeFloat32(reflect.ValueOf(float32(real(c))))
-	i := s.encodeFloat32(reflect.ValueOf(float32(imag(c))))
-	return append(r, i...)
+	s.encodeFloat32(reflect.ValueOf(float32(real(c))))
+	s.encodeFloat32(reflect.ValueOf(float32(imag(c))))
 }
 
-func (s *Serializer) encodeComplex128(v reflect.Value) []byte {
+func (s *Serializer) encodeComplex128(v reflect.Value) {
 	c := v.Complex()
-	r := s.encodeFloat64(reflect.ValueOf(real(c)))
-	i := s.encodeFloat64(reflect.ValueOf(imag(c)))
-	return append(r, i...)
+	s.encodeFloat64(reflect.ValueOf(real(c)))
+	s.encodeFloat64(reflect.ValueOf(imag(c)))
 }
 
-func (s *Serializer) encodeUintptr(v reflect.Value) []byte {
-	return s.encodeUint64(v)
+func (s *Serializer) encodeUintptr(v reflect.Value) {
+	s.encodeUint64(v)
 }
 
-func (s *Serializer) encodeUnsafePointer(v reflect.Value) []byte {
-	return u2bs(uint64(v.Pointer()), 4)
+func (s *Serializer) encodeUnsafePointer(v reflect.Value) {
+	s.writeUint(uint64(v.Pointer()), 4)
 }
 
-func (s *Serializer) encodeChan(v reflect.Value) []byte {
+func (s *Serializer) encodeChan(v reflect.Value) {
 	if v.IsNil() {
-		return []byte{meta_nil}
+		s.writeByte(meta_nil)
+		return
 	}
-	return append([]byte{meta_nonil}, c2b(v.Cap())...)
+	s.writeByte(meta_nonil)
+	s.writeCount(v.Cap())
 }
 
-func (s *Serializer) encodeFunc(v reflect.Value) []byte {
+func (s *Serializer) encodeFunc(v reflect.Value) {
 	if v.IsNil() {
-		return []byte{meta_nil}
+		s.writeByte(meta_nil)
+	} else {
+		s.writeByte(meta_nonil)
 	}
-	return []byte{meta_nonil}
 }
 
-func (s *Serializer) encodeArray(nodeId int) []byte {
-	b := []byte{meta_cntr}
-	for _, cntrId := range s.values.children(nodeId) {
+func (s *Serializer) encodeArray(p *typePlan, v reflect.Value, nodeId int) {
+	s.writeByte(meta_cntr)
+	s.encodeElems(p, v, nodeId)
+}
+
+func (s *Serializer) encodeSlice(p *typePlan, v reflect.Value, nodeId int) {
+	if v.IsNil() {
+		s.writeByte(meta_nil)
+		return
+	}
+	s.writeByte(meta_nonil)
+	s.writeCount(v.Len())
+	s.writeCount(v.Cap())
+	s.encodeElems(p, v, nodeId)
+}
+
+func (s *Serializer) encodeElems(p *typePlan, v reflect.Value, nodeId int) {
+	cntrIds := s.values.children(nodeId)
+	if p.scalarElems && len(cntrIds) == 0 {
+		elemPlan := s.typeRegistry.planOf(v.Type().Elem())
+		for i, length := 0, v.Len(); i < length; i++ {
+			s.encodeScalar(elemPlan, v.Index(i))
+		}
+		return
+	}
+	for i, cntrId := range cntrIds {
+		if cntrId == scalarNode {
+			s.encodeScalar(s.typeRegistry.planOf(v.Type().Elem()), v.Index(i))
+			continue
+		}
 		s.values.visit(cntrId)
-		b = append(b, s.encodeContainer(cntrId)...)
+		s.encodeContainer(cntrId)
 	}
-	return b
 }
 
-func (s *Serializer) encodeSlice(nodeId int) []byte {
-	return nil
+// encodeScalar encodes scalar element or field v, which has no node
+func (s *Serializer) encodeScalar(p *typePlan, v reflect.Value) {
+	p.encode(s, v, scalarNode)
+	s.flushFull()
 }
 
-func (s *Serializer) encodeMap(v reflect.Value, nodeId int) []byte {
+func (s *Serializer) encodeMap(v reflect.Value, nodeId int) {
 	if v.IsNil() {
-		return []byte{meta_nil}
+		s.writeByte(meta_nil)
+		return
 	}
-	b := append([]byte{meta_nonil}, c2b(v.Len())...)
+	s.writeByte(meta_nonil)
+	s.writeCount(v.Len())
 	for _, id := range s.values.children(nodeId) {
-		b = append(b, s.encodeValue(s.values.get(id), id)...)
+		s.visitValue(s.values.get(id), id)
+	}
+}
+
+func (s *Serializer) encodeStruct(fields structFields, v reflect.Value, nodeId int) {
+	s.writeByte(meta_cntr)
+	fieldIds := s.values.children(nodeId)
+	if fields.tagged || s.structCodingMode == StructCodingModeName {
+		s.writeCount(len(fieldIds))
+	}
+	encodedFields := fields.encodedFields(s.structCodingMode)
+	for i, fieldId := range fieldIds {
+		if s.structCodingMode == StructCodingModeName {
+			s.encodeNamedField(v, encodedFields[i], fieldId)
+			continue
+		}
+		s.encodeField(v, encodedFields[i], fieldId)
+	}
+}
+
+// encodeNamedField encodes the name of the field followed by the number of ids and bytes
+// taken by the field value, so that decoders of the struct without such field can skip it
+func (s *Serializer) encodeNamedField(v reflect.Value, f structField, fieldId int) {
+	s.writeCount(len(f.name))
+	s.writeString(f.name)
+	idCount := 2 // ids of the container and the value of the scalar field
+	if fieldId != scalarNode {
+		idCount = s.values.idCount(fieldId)
+	}
+	s.writeCount(idCount)
+	if s.w != nil && !s.measuring {
+		s.encodeMeasuredField(v, f, fieldId)
+		return
+	}
+	sizeId := len(s.fieldSizes)
+	if s.measuring {
+		s.fieldSizes = append(s.fieldSizes, 0)
+	}
+	var slot [fieldSizeLength]byte
+	s.buf = append(s.buf, slot[:]...)
+	start := s.flushed + len(s.buf)
+	s.encodeField(v, f, fieldId)
+	size := s.flushed + len(s.buf) - start
+	if s.measuring {
+		s.fieldSizes[sizeId] = size
+		if !putU2bs(slot[:], uint64(size), 4) {
+			s.flushed += len(u2bs(uint64(size), 4)) - fieldSizeLength // the size takes more bytes than the slot
+		}
+		return
+	}
+	// the data is not flushed without measuring, so the slot is in the buffer
+	if slot := s.buf[start-fieldSizeLength : start]; !putU2bs(slot, uint64(size), 4) {
+		s.buf = slices.Replace(s.buf, start-fieldSizeLength, start, u2bs(uint64(size), 4)...)
+	}
+}
+
+// encodeMeasuredField encodes the field of the streamed value with the size measured before
+func (s *Serializer) encodeMeasuredField(v reflect.Value, f structField, fieldId int) {
+	size := s.fieldSizes[s.nextField]
+	s.nextField++
+	var slot [fieldSizeLength]byte
+	if putU2bs(slot[:], uint64(size), 4) {
+		s.buf = append(s.buf, slot[:]...)
+	} else {
+		s.writeCount(size)
+	}
+	start := s.flushed + len(s.buf)
+	s.encodeField(v, f, fieldId)
+	if encoded := s.flushed + len(s.buf) - start; encoded != size {
+		panic(fmt.Errorf("field %s takes %d bytes instead of measured %d: its marshaler returns different data", f.name, encoded, size))
 	}
-	return b
 }
 
-func (s *Serializer) encodeStruct(nodeId int) []byte {
-	b := []byte{meta_cntr}
-	for _, fieldId := range s.values.children(nodeId) {
-		s.values.visit(fieldId)
-		b = append(b, s.encodeContainer(fieldId)...)
+func (s *Serializer) encodeField(v reflect.Value, f structField, fieldId int) {
+	if fieldId == scalarNode {
+		s.encodeScalarField(v, f)
+		return
+	}
+	s.values.visit(fieldId)
+	s.encodeContainer(fieldId)
+}
+
+func (s *Serializer) encodeScalarField(v reflect.Value, f structField) {
+	field := v.Field(f.index)
+	if f.isSuperseded() {
+		field = reflex.Zero(field.Type())
 	}
-	return b
+	s.encodeScalar(s.typeRegistry.planOf(field.Type()), field)
 }
 
-func (s *Serializer) encodeInterface(nodeId int) []byte {
-	return s.encodeNode(s.values.children(nodeId)[0])
+func (s *Serializer) encodeInterface(nodeId int) {
+	s.encodeNode(s.values.children(nodeId)[0])
 }
 
-func (s *Serializer) encodePointer(nodeId int) []byte {
+func (s *Serializer) encodePointer(nodeId int) {
 	childs := s.values.children(nodeId)
 	if len(childs) == 0 {
-		return []byte{meta_nil}
+		s.writeByte(meta_nil)
+		return
 	}
 	childId := childs[0]
-	b := s.visitValue(s.values.get(childId), childId)
-	return append([]byte{meta_nonil}, b...)
+	s.writeByte(meta_nonil)
+	if s.values.isContainer(childId) {
+		// containers are encoded by their owners, so the pointer always refers to the container
+		s.encodeReference(childId)
+		return
+	}
+	s.visitValue(s.values.get(childId), childId)
 }
 
-func (s *Serializer) encodeReference(id int) []byte {
-	return append([]byte{meta_ref}, c2b(id)...)
+func (s *Serializer) encodeReference(nodeId int) {
+	s.writeByte(meta_ref)
+	s.writeCount(s.values.id(nodeId))
 }
 
-func (s *Serializer) encodeSerializable(v reflect.Value) []byte {
-	/*if isNil(v) {
-		return s.encodeNil()
-	}
+func (s *Serializer) encodeSerializable(p *typePlan, v reflect.Value, nodeId int) {
 	var b []byte
-	if v.Kind() == reflect.Pointer {
-		cnt, ok := s.refs[s.valueSignature(v.Elem())]
-		if ok {
-			return append([]byte{1}, s.encodeReference(cnt)...)
+	var err error
+	switch p.marshaler {
+	case registryCodec:
+		b, err = p.codec.enc(reflex.MakeExported(v).Interface())
+	case serializableMarshaler:
+		b = marshalerValue(v, serializableInterfaceType).(Serializable).Serialize()
+	case codecMarshaler:
+		childId := s.values.children(nodeId)[0]
+		s.visitValue(s.values.get(childId), childId)
+		return
+	case binaryMarshaler:
+		b, err = marshalerValue(v, binaryMarshalerInterfaceType).(encoding.BinaryMarshaler).MarshalBinary()
+	case gobMarshaler:
+		b, err = marshalerValue(v, gobEncoderInterfaceType).(gob.GobEncoder).GobEncode()
+	}
+	if err != nil {
+		panic(fmt.Errorf("cannot marshal value of type %s: %w", v.Type(), err))
+	}
+	s.writeCount(len(b))
+	s.write(b)
+}
+
+// marshalerValue returns v or pointer to v, whichever implements the marshaler interface i
+func marshalerValue(v reflect.Value, i reflect.Type) any {
+	v = reflex.MakeExported(v)
+	if !v.Type().Implements(i) {
+		if v.CanAddr() {
+			v = v.Addr()
+		} else {
+			v = reflex.PtrTo(v.Type(), v)
 		}
-		b = []byte{0}
 	}
-	body := v.MethodByName("Serialize").Call(nil)[0].Interface().([]byte)
-	return append(b, body...)*/
-	return nil
+	return v.Interface()
+}
+
+func (s *Serializer) write(b []byte) {
+	s.buf = append(s.buf, b...)
+}
+
+func (s *Serializer) writeByte(b byte) {
+	s.buf = append(s.buf, b)
+}
+
+func (s *Serializer) writeString(str string) {
+	s.buf = append(s.buf, str...)
+}
+
+// writeUint writes v encoded by u2bs
+func (s *Serializer) writeUint(v uint64, sizeBits int) {
+	s.buf = appendU2bs(s.buf, v, sizeBits)
+}
+
+// writeCount writes the length or the count encoded by c2b
+func (s *Serializer) writeCount(n int) {
+	s.buf = appendU2bs(s.buf, uint64(n), 4)
+}
+
+// flushFull writes the buffered data of the streaming encoding to the destination once there are flushSize bytes
+func (s *Serializer) flushFull() {
+	if s.w != nil && len(s.buf) >= flushSize {
+		s.flush()
+	}
+}
+
+// flush writes the buffered data of the streaming encoding to the destination (or discards it while measuring)
+func (s *Serializer) flush() {
+	if !s.measuring {
+		if _, err := s.w.Write(s.buf); err != nil {
+			panic(err)
+		}
+	}
+	s.flushed += len(s.buf)
+	s.buf = s.buf[:0]
 }
 
 func Serialize(value any, options ...any) []byte {
@@ -460,3 +783,11 @@ func Serialize(value any, options ...any) []byte {
 		WithOptions(options).
 		Encode(value)
 }
+
+func TrySerialize(value any, options ...any) ([]byte, error) {
+	s := NewSerializer()
+	if err := s.applyOptions(options); err != nil {
+		return nil, err
+	}
+	return s.TryEncode(value)
+}
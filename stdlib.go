@@ -0,0 +1,281 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var locations sync.Map // time zone names and their loaded locations
+
+// RegisterStdlibTypes registers types of the standard library that have compact encodings:
+// time.Time is encoded as its instant and time zone (name and offset), *time.Location as its name,
+// time.Duration as int64. Monotonic clock readings are not encoded.
+// big.Int, big.Rat and big.Float are encoded as their signs and magnitudes, big.Float also keeps
+// its precision, rounding mode and accuracy. Pointers to them are encoded as usual pointers.
+//
+// A decoded time.Time gets the location with the encoded name if the location is available
+// and has the same offset at the instant, otherwise it gets a fixed zone with the encoded name and offset.
+func (r *TypeRegistry) RegisterStdlibTypes() {
+	r.RegisterCodec(reflect.TypeOf(time.Time{}), encodeTime, decodeTime)
+	r.RegisterCodec(reflect.TypeOf((*time.Location)(nil)), encodeLocation, decodeLocation)
+	r.RegisterType(reflect.TypeOf(time.Duration(0)))
+	r.RegisterCodec(reflect.TypeOf((*big.Int)(nil)).Elem(), encodeBigInt, decodeBigInt)
+	r.RegisterCodec(reflect.TypeOf((*big.Rat)(nil)).Elem(), encodeBigRat, decodeBigRat)
+	r.RegisterCodec(reflect.TypeOf((*big.Float)(nil)).Elem(), encodeBigFloat, decodeBigFloat)
+}
+
+func encodeTime(v any) ([]byte, error) {
+	t := v.(time.Time)
+	_, offset := t.Zone()
+	data := appendU2bs(nil, i2u(t.Unix()), 4)
+	data = appendU2bs(data, uint64(t.Nanosecond()), 3)
+	data = appendU2bs(data, i2u(int64(offset)), 3)
+	return append(data, t.Location().String()...), nil
+}
+
+func decodeTime(data []byte) (any, error) {
+	sec, data, ok := cutUint(data, 4)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	nsec, data, ok := cutUint(data, 3)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	offset, data, ok := cutUint(data, 3)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	if nsec >= uint64(time.Second) {
+		return nil, fmt.Errorf("invalid nanoseconds %d", nsec)
+	}
+	t := time.Unix(u2i(sec), int64(nsec))
+	return t.In(locationAt(t, string(data), int(u2i(offset)))), nil
+}
+
+// locationAt returns the location with the given name if it has the offset at the instant t,
+// otherwise it returns a fixed zone
+func locationAt(t time.Time, name string, offset int) *time.Location {
+	if loc, ok := loadLocation(name); ok {
+		if _, actual := t.In(loc).Zone(); actual == offset {
+			return loc
+		}
+	}
+	return time.FixedZone(name, offset)
+}
+
+func encodeLocation(v any) ([]byte, error) {
+	loc := v.(*time.Location)
+	if loc == nil {
+		return nil, nil
+	}
+	// the offset restores fixed zones and locations missing in the time zone database of the decoder
+	_, offset := time.Unix(0, 0).In(loc).Zone()
+	return append(appendU2bs(nil, i2u(int64(offset)), 3), loc.String()...), nil
+}
+
+func decodeLocation(data []byte) (any, error) {
+	if len(data) == 0 {
+		return (*time.Location)(nil), nil
+	}
+	offset, data, ok := cutUint(data, 3)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	name := string(data)
+	if loc, ok := loadLocation(name); ok {
+		return loc, nil
+	}
+	return time.FixedZone(name, int(u2i(offset))), nil
+}
+
+// loadLocation returns the location with the given name, successfully loaded locations are cached
+func loadLocation(name string) (*time.Location, bool) {
+	switch name {
+	case "": // name of anonymous fixed zones, while time.LoadLocation returns UTC
+		return nil, false
+	case "UTC":
+		return time.UTC, true
+	case "Local":
+		return time.Local, true
+	}
+	if loc, exists := locations.Load(name); exists {
+		return loc.(*time.Location), true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	locations.Store(name, loc)
+	return loc, true
+}
+
+func encodeBigInt(v any) ([]byte, error) {
+	x := v.(big.Int)
+	return appendBigInt(nil, &x), nil
+}
+
+func decodeBigInt(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, ErrUnexpectedEOF
+	}
+	return bigIntOf(data[0], data[1:])
+}
+
+// appendBigInt appends the sign and the magnitude of x in big endian
+func appendBigInt(data []byte, x *big.Int) []byte {
+	return append(append(data, bigIntSign(x)), x.Bytes()...)
+}
+
+// bigIntSign returns 1 for negative numbers and 0 otherwise
+func bigIntSign(x *big.Int) byte {
+	if x.Sign() < 0 {
+		return 1
+	}
+	return 0
+}
+
+func bigIntOf(sign byte, magnitude []byte) (*big.Int, error) {
+	x := new(big.Int).SetBytes(magnitude)
+	switch sign {
+	case 0:
+		return x, nil
+	case 1:
+		return x.Neg(x), nil
+	default:
+		return nil, fmt.Errorf("invalid sign %d", sign)
+	}
+}
+
+// encodeBigRat encodes the numerator (sign, length and magnitude) and the magnitude of the denominator
+func encodeBigRat(v any) ([]byte, error) {
+	x := v.(big.Rat)
+	num := x.Num().Bytes()
+	data := appendU2bs([]byte{bigIntSign(x.Num())}, uint64(len(num)), 4)
+	data = append(data, num...)
+	return append(data, x.Denom().Bytes()...), nil
+}
+
+func decodeBigRat(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, ErrUnexpectedEOF
+	}
+	sign := data[0]
+	length, data, ok := cutUint(data[1:], 4)
+	if !ok || length > uint64(len(data)) {
+		return nil, ErrUnexpectedEOF
+	}
+	num, err := bigIntOf(sign, data[:length])
+	if err != nil {
+		return nil, err
+	}
+	denom := new(big.Int).SetBytes(data[length:])
+	if denom.Sign() == 0 {
+		return nil, errors.New("zero denominator")
+	}
+	return new(big.Rat).SetFrac(num, denom), nil
+}
+
+// big.Float forms
+const (
+	bigFloatZero byte = iota
+	bigFloatFinite
+	bigFloatInf
+)
+
+// encodeBigFloat encodes the header byte (the sign bit, 2 bits of the form, 2 bits of the accuracy
+// and 3 bits of the rounding mode) and the precision, finite numbers are followed by the exponent
+// and the magnitude of the integer mantissa without trailing zero bits.
+// Accuracy of zeros and infinities (after exponent underflow or overflow) is not restored.
+func encodeBigFloat(v any) ([]byte, error) {
+	x := v.(big.Float)
+	form := bigFloatFinite
+	switch {
+	case x.IsInf():
+		form = bigFloatInf
+	case x.Sign() == 0:
+		form = bigFloatZero
+	}
+	header := byte(x.Mode()) | byte(x.Acc()+1)<<3 | form<<5
+	if x.Signbit() {
+		header |= 1 << 7
+	}
+	data := appendU2bs([]byte{header}, uint64(x.Prec()), 3)
+	if form != bigFloatFinite {
+		return data, nil
+	}
+	mant := new(big.Float)
+	exp := x.MantExp(mant)
+	mantissa, _ := mant.SetMantExp(mant, int(x.Prec())).Int(nil)
+	mantissa.Abs(mantissa)
+	zeros := mantissa.TrailingZeroBits()
+	mantissa.Rsh(mantissa, zeros)
+	data = appendU2bs(data, i2u(int64(exp)-int64(x.Prec())+int64(zeros)), 4)
+	return append(data, mantissa.Bytes()...), nil
+}
+
+func decodeBigFloat(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, ErrUnexpectedEOF
+	}
+	header := data[0]
+	prec, data, ok := cutUint(data[1:], 3)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	mode, acc, form, neg := big.RoundingMode(header&0b111), big.Accuracy(header>>3&0b11)-1, header>>5&0b11, header>>7 != 0
+	if mode > big.ToPositiveInf || acc > big.Above || form > bigFloatInf || prec > big.MaxPrec {
+		return nil, fmt.Errorf("invalid header %#08b or precision %d", header, prec)
+	}
+	z := new(big.Float).SetMode(mode).SetPrec(uint(prec))
+	switch form {
+	case bigFloatZero:
+		if neg {
+			z.Neg(z)
+		}
+		return z, nil
+	case bigFloatInf:
+		return z.SetInf(neg), nil
+	}
+	exp, data, ok := cutUint(data, 4)
+	if !ok {
+		return nil, ErrUnexpectedEOF
+	}
+	mantissa := new(big.Int).SetBytes(data)
+	if mantissa.Sign() == 0 || uint64(mantissa.BitLen()) > prec {
+		return nil, fmt.Errorf("invalid mantissa of precision %d", prec)
+	}
+	x := new(big.Float).SetInt(mantissa)
+	x.SetMantExp(x, int(u2i(exp)))
+	if neg {
+		x.Neg(x)
+	}
+	if acc == big.Exact {
+		return z.Set(x), nil
+	}
+	// the accuracy is restored by rounding the number shifted by 1/8 of its ulp towards the exact value
+	shift := new(big.Float).SetMantExp(big.NewFloat(1), x.MantExp(nil)-int(prec)-3)
+	exact := new(big.Float).SetPrec(uint(prec) + 4).Set(x)
+	if acc == big.Below {
+		exact.Add(exact, shift)
+	} else {
+		exact.Sub(exact, shift)
+	}
+	if z.Set(exact); z.Acc() != acc || z.Cmp(x) != 0 {
+		return nil, fmt.Errorf("accuracy %s is inconsistent with rounding mode %s", acc, mode)
+	}
+	return z, nil
+}
+
+// cutUint reads the number encoded by u2bs from the beginning of data and returns the rest of data
+func cutUint(data []byte, sizeBits int) (v uint64, rest []byte, ok bool) {
+	v, length := bs2u(data, sizeBits)
+	if length <= 0 {
+		return 0, data, false
+	}
+	return v, data[length:], true
+}
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tagName = "codec"
+
+// StructCodingMode determines how fields of structs are identified in encoded data
+type StructCodingMode int
+
+const (
+	// StructCodingModeIndex identifies fields by their positions in struct (or by indexes of codec tags)
+	StructCodingModeIndex StructCodingMode = iota
+	// StructCodingModeName identifies fields by their names, so fields can be reordered freely
+	StructCodingModeName
+)
+
+type structField struct {
+	index      int // index of the field in the struct
+	name       string
+	removed    bool
+	migratedTo int  // index of the field in the struct that replaces the current one, -1 if there is no replacement
+	scalar     bool // whether the field has a scalar type (see typePlan)
+}
+
+// isSuperseded reports whether the field is not used anymore, so its value is not encoded
+func (f structField) isSuperseded() bool {
+	return f.removed || f.migratedTo >= 0
+}
+
+type structFields struct {
+	tagged  bool                   // whether the fields are defined by codec tags
+	fields  []structField          // fields in encoding order
+	named   []structField          // fields encoded in the name mode
+	indexes map[string]structField // fields by their names
+}
+
+// encodedFields returns the fields which values are encoded in the given mode.
+// In the name mode superseded and blank fields are omitted, since positions of fields do not matter.
+func (f structFields) encodedFields(mode StructCodingMode) []structField {
+	if mode != StructCodingModeName {
+		return f.fields
+	}
+	return f.named
+}
+
+func (f structFields) fieldByName(name string) (structField, bool) {
+	field, exists := f.indexes[name]
+	return field, exists
+}
+
+// withNames fills the fields used in the name mode
+func (f structFields) withNames() structFields {
+	f.named = make([]structField, 0, len(f.fields))
+	f.indexes = make(map[string]structField, len(f.fields))
+	for _, field := range f.fields {
+		if !field.isSuperseded() && field.name != "_" {
+			f.named = append(f.named, field)
+		}
+		if _, exists := f.indexes[field.name]; !exists {
+			f.indexes[field.name] = field
+		}
+	}
+	return f
+}
+
+// structFieldsOf returns the fields of struct type t to encode.
+// If no field has the codec tag, all fields are encoded in order they are defined,
+// otherwise only tagged fields are encoded in order of their indexes.
+func structFieldsOf(t reflect.Type) structFields {
+	var fields []structField
+	tagIndexes := make(map[int]int) // tag indexes and indexes of the fields in the struct
+	fieldTags := make(map[int]int)  // indexes of the fields in the struct and their tag indexes
+	migrations := make(map[int]int) // indexes of the migrated fields and tag indexes of their replacements
+	for i, count := 0, t.NumField(); i < count; i++ {
+		tag, exists := t.Field(i).Tag.Lookup(tagName)
+		if !exists {
+			continue
+		}
+		field, tagIndex, migratedTo := parseTag(t, i, tag)
+		if _, exists = tagIndexes[tagIndex]; exists {
+			panic(fmt.Errorf("duplicate index %d in codec tag of field %s.%s", tagIndex, t, t.Field(i).Name))
+		}
+		tagIndexes[tagIndex] = i
+		fieldTags[i] = tagIndex
+		if migratedTo >= 0 {
+			migrations[i] = migratedTo
+		}
+		fields = append(fields, field)
+	}
+	if fields == nil {
+		fields = make([]structField, t.NumField())
+		for i := range fields {
+			fields[i] = structField{index: i, name: t.Field(i).Name, migratedTo: -1}
+		}
+		return structFields{fields: fields}.withNames()
+	}
+	for i := range fields {
+		tagIndex, exists := migrations[fields[i].index]
+		if !exists {
+			continue
+		}
+		if fields[i].migratedTo, exists = tagIndexes[tagIndex]; !exists {
+			panic(fmt.Errorf("field %s.%s is migrated to unknown index %d", t, t.Field(fields[i].index).Name, tagIndex))
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fieldTags[fields[i].index] < fieldTags[fields[j].index]
+	})
+	return structFields{tagged: true, fields: fields}.withNames()
+}
+
+func parseTag(t reflect.Type, fieldIndex int, tag string) (field structField, tagIndex, migratedTo int) {
+	field = structField{index: fieldIndex, name: t.Field(fieldIndex).Name, migratedTo: -1}
+	tagIndex, migratedTo = -1, -1
+	for _, option := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		var err error
+		switch key {
+		case "index":
+			tagIndex, err = strconv.Atoi(value)
+		case "removed":
+			field.removed = true
+		case "migratedTo":
+			migratedTo, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			panic(fmt.Errorf("invalid codec tag of field %s.%s: %w", t, t.Field(fieldIndex).Name, err))
+		}
+	}
+	if tagIndex < 0 {
+		panic(fmt.Errorf("codec tag of field %s.%s must contain index", t, t.Field(fieldIndex).Name))
+	}
+	return
+}
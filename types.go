@@ -3,26 +3,52 @@ package codec
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 	"unsafe"
 
 	"github.com/URALINNOVATSIYA/reflex"
 )
 
+// TypeIdMode determines how types of values are identified in encoded data
+type TypeIdMode int
+
+const (
+	// TypeIdModeRegistry identifies types by their ids in the type registry,
+	// so the types must be registered in the same order when data is encoded and decoded
+	TypeIdModeRegistry TypeIdMode = iota
+	// TypeIdModeName additionally encodes the name of each type with the first occurrence of its id,
+	// so the decoder maps the names to the ids of its own type registry
+	TypeIdModeName
+)
+
 type TypeRegistry struct {
 	typeAutoReg bool
 	types       map[int]reflect.Type           // registered types
 	funcs       map[reflect.Type]reflect.Value // registered functions
 	ids         map[string]int                 // type full names and their ids
+	funcNames   map[string]bool                // names of the registered functions
+	nextId      int                            // id of the next registered type, ids are never reused
+	codecs      map[reflect.Type]typeCodec     // external codecs of types
+	plans       sync.Map                       // compiled coding plans of types (see planOf)
 	mx          sync.RWMutex
 }
 
+// typeCodec encodes and decodes values of a type as a whole, like Serializable does
+type typeCodec struct {
+	enc func(v any) ([]byte, error)
+	dec func(data []byte) (any, error)
+}
+
 func NewTypeRegistry(typeAutoReg bool) *TypeRegistry {
 	return &TypeRegistry{
 		typeAutoReg: typeAutoReg,
 		types:       make(map[int]reflect.Type),
 		funcs:       make(map[reflect.Type]reflect.Value),
 		ids:         make(map[string]int),
+		funcNames:   make(map[string]bool),
+		nextId:      1,
+		codecs:      make(map[reflect.Type]typeCodec),
 	}
 }
 
@@ -34,11 +60,17 @@ func (r *TypeRegistry) TurnOffTypeAutoRegistration() {
 	r.typeAutoReg = false
 }
 
+// RegisteredTypeNames returns names of the registered types (and the types pinned by a manifest) ordered by their ids
 func (r *TypeRegistry) RegisteredTypeNames() []string {
-	names := make([]string, len(r.ids))
-	for name, i := range r.ids {
-		names[i] = name
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	names := make([]string, 0, len(r.ids))
+	for name := range r.ids {
+		names = append(names, name)
 	}
+	sort.Slice(names, func(i, j int) bool {
+		return r.ids[names[i]] < r.ids[names[j]]
+	})
 	return names
 }
 
@@ -76,7 +108,7 @@ func (r *TypeRegistry) RegisterTypeOf(v any) {
 
 func (r *TypeRegistry) RegisterType(t reflect.Type) {
 	name := reflex.NameOf(t)
-	if _, exists := r.typeIdByName(name); exists {
+	if _, bound := r.boundTypeId(name); bound {
 		return
 	}
 	r.bindTypeWithName(t, name)
@@ -88,37 +120,108 @@ func (r *TypeRegistry) RegisterFunc(f any) {
 		panic(fmt.Errorf("argument of RegisterFunc is not function"))
 	}
 	name := reflex.FuncNameOf(v)
-	if _, exists := r.typeIdByName(name); exists {
+	if _, bound := r.boundTypeId(name); bound {
 		return
 	}
 	r.bindFuncWithName(v, name)
 }
 
-func (r *TypeRegistry) typeById(id int) reflect.Type {
+// RegisterCodec registers type t and the functions that encode and decode its values,
+// so that types of other packages can be serialized as if they implemented Serializable.
+// dec may return either the value or pointer to it. Codecs take precedence over Serializable
+// and other marshalers of the type, and they are used only by serializers and unserializers of the registry.
+// If t is a pointer type, the pointers are encoded by the codec, while copies of the same pointer are still encoded as references.
+func (r *TypeRegistry) RegisterCodec(t reflect.Type, enc func(v any) ([]byte, error), dec func(data []byte) (any, error)) {
+	if t == nil || t.Kind() == reflect.Interface {
+		panic(fmt.Errorf("codec cannot be registered for type %s", typeString(t)))
+	}
+	if enc == nil || dec == nil {
+		panic(fmt.Errorf("codec functions of type %s must not be nil", t))
+	}
+	r.RegisterType(t)
+	r.mx.Lock()
+	r.codecs[t] = typeCodec{enc, dec}
+	r.mx.Unlock()
+	r.resetPlans()
+}
+
+// RegisterCodecOf is the typed equivalent of TypeRegistry.RegisterCodec
+func RegisterCodecOf[T any](r *TypeRegistry, enc func(v T) ([]byte, error), dec func(data []byte) (T, error)) {
+	r.RegisterCodec(
+		reflect.TypeOf((*T)(nil)).Elem(),
+		func(v any) ([]byte, error) {
+			return enc(v.(T))
+		},
+		func(data []byte) (any, error) {
+			return dec(data)
+		},
+	)
+}
+
+func (r *TypeRegistry) codecOf(t reflect.Type) (c typeCodec, exists bool) {
 	r.mx.RLock()
-	t, exists := r.types[id]
+	c, exists = r.codecs[t]
 	r.mx.RUnlock()
+	return
+}
+
+// marshalerOf returns the marshaler of type t taking into account the registered codecs
+func (r *TypeRegistry) marshalerOf(t reflect.Type) marshaler {
+	if _, exists := r.codecOf(t); exists {
+		return registryCodec
+	}
+	return marshalerOf(t)
+}
+
+func (r *TypeRegistry) typeById(id int) reflect.Type {
+	t, exists := r.lookupType(id)
 	if !exists {
-		panic(fmt.Errorf("unrecognized type [id: %d]", id))
+		panic(fmt.Errorf("%w: %d", ErrUnknownTypeId, id))
 	}
 	return t
 }
 
+func (r *TypeRegistry) lookupType(id int) (t reflect.Type, exists bool) {
+	r.mx.RLock()
+	t, exists = r.types[id]
+	r.mx.RUnlock()
+	return
+}
+
+// typeByName returns the registered type (or function type) with the given name
+func (r *TypeRegistry) typeByName(name string) reflect.Type {
+	id, exists := r.typeIdByName(name)
+	if !exists {
+		panic(fmt.Errorf("%w: type %s is not registered", ErrUnknownTypeId, name))
+	}
+	return r.typeById(id)
+}
+
 func (r *TypeRegistry) typeIdByValue(v reflect.Value) int {
-	var name string
-	var t reflect.Type
-	if v.Kind() == reflect.Func {
-		name = reflex.FuncNameOf(v)
-	} else {
-		if v.IsValid() {
-			t = v.Type()
-		}
-		name = reflex.NameOf(t)
+	if !v.IsValid() || v.Kind() == reflect.Func {
+		return r.bindValueType(v, typeNameOf(v))
+	}
+	// ids of types are never changed, so they are cached in plans, while functions of the same type have different ids
+	p := r.planOf(v.Type())
+	id := int(p.id.Load())
+	if id == 0 {
+		id = r.bindValueType(v, p.name)
+		p.id.Store(int32(id))
 	}
-	if id, exists := r.typeIdByName(name); exists {
+	return id
+}
+
+// bindValueType returns id of the type (or the function) of v with the given name binding it to the id if necessary
+func (r *TypeRegistry) bindValueType(v reflect.Value, name string) int {
+	if id, bound := r.boundTypeId(name); bound {
 		return id
 	}
-	if !r.typeAutoReg {
+	var t reflect.Type
+	if v.IsValid() {
+		t = v.Type()
+	}
+	// types pinned by a manifest are bound to their ids even if auto registration is turned off
+	if _, pinned := r.typeIdByName(name); !pinned && !r.typeAutoReg {
 		panic(fmt.Errorf("unregistered type: %s", name))
 	}
 	var id int
@@ -137,6 +240,16 @@ func (r *TypeRegistry) typeIdByName(name string) (id int, exists bool) {
 	return
 }
 
+// boundTypeId returns id of the type with the given name and whether the type is bound to the id
+func (r *TypeRegistry) boundTypeId(name string) (id int, bound bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	if id, bound = r.ids[name]; bound {
+		_, bound = r.types[id]
+	}
+	return
+}
+
 func (r *TypeRegistry) funcByType(t reflect.Type) reflect.Value {
 	r.mx.RLock()
 	v, exists := r.funcs[t]
@@ -161,6 +274,7 @@ func (r *TypeRegistry) bindFuncWithName(v reflect.Value, name string) int {
 	t := v.Type()
 	r.types[id] = t
 	r.funcs[t] = v
+	r.funcNames[name] = true
 	r.mx.Unlock()
 	return id
 }
@@ -168,12 +282,24 @@ func (r *TypeRegistry) bindFuncWithName(v reflect.Value, name string) int {
 func (r *TypeRegistry) assignTypeId(name string) int {
 	id, exists := r.ids[name]
 	if !exists {
-		id = len(r.ids) + 1
+		id = r.nextId
+		r.nextId++
 		r.ids[name] = id
 	}
 	return id
 }
 
+// typeNameOf returns the name which the type of v (or the function v) is registered with
+func typeNameOf(v reflect.Value) string {
+	if v.Kind() == reflect.Func {
+		return reflex.FuncNameOf(v)
+	}
+	if v.IsValid() {
+		return reflex.NameOf(v.Type())
+	}
+	return reflex.NameOf(nil)
+}
+
 func GetDefaultTypeRegistry() *TypeRegistry {
 	return defaultTypeReg
 }
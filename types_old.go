@@ -25,17 +25,17 @@ const (
 )
 
 const (
-	version byte = 0b0000_0001 // 1 - version of the serializer
-	signed  byte = 0b0000_1000 // for signed and unsigned integers
-	meta    byte = 0b0000_0100 // for fixed size integers to determine whether the integer representation has meta information about its byte size
-	wide    byte = 0b0000_1000 // == 1 for larger bit representations (for floats and complex numbers)
-	tru     byte = 0b0000_0001 // for true booleans
-	fixed   byte = 0b0000_1000 // for lists that are arrays (i.e. have fixed size)
-	raw     byte = 0b0000_1000 // determines unsafe.Pointer for tUintptr
-	val     byte = 0b0000_1000 // determines a reference that contains a value that some pointer points to
-	custom  byte = 0b0000_1000 // determines whether the type implements custom serialization
-	null    byte = 0b0000_0100 // determines whether underlying type value is nil
-	mask    byte = 0b1111_0000 // type mask
+	version1 byte = 0b0000_0001 // 1 - version of the typeChecker-based serializer
+	signed   byte = 0b0000_1000 // for signed and unsigned integers
+	meta     byte = 0b0000_0100 // for fixed size integers to determine whether the integer representation has meta information about its byte size
+	wide     byte = 0b0000_1000 // == 1 for larger bit representations (for floats and complex numbers)
+	tru      byte = 0b0000_0001 // for true booleans
+	fixed    byte = 0b0000_1000 // for lists that are arrays (i.e. have fixed size)
+	raw      byte = 0b0000_1000 // determines unsafe.Pointer for tUintptr
+	val      byte = 0b0000_1000 // determines a reference that contains a value that some pointer points to
+	custom   byte = 0b0000_1000 // determines whether the type implements custom serialization
+	null     byte = 0b0000_0100 // determines whether underlying type value is nil
+	mask     byte = 0b1111_0000 // type mask
 )
 
 // Booleans
@@ -1,9 +1,15 @@
 package codec
 
 import (
+	"bytes"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/URALINNOVATSIYA/reflex"
 )
 
 // Test types
@@ -67,6 +73,28 @@ type (
 		f6 string
 		f7 *testStruct1
 	}
+	testStruct6 struct {
+		f1 int
+		f2 bool
+		F3 string
+		F4 byte
+		f5 string
+	}
+	testStruct7 struct {
+		f1 int8    `codec:"index=1,migratedTo=3"`
+		f2 string  `codec:"index=2,removed"`
+		f3 int64   `codec:"index=3"`
+		f4 []byte  `codec:"index=4"`
+		f5 float64 // not encoded
+	}
+	testStruct8 struct { // testStruct6 with fields added in a later release
+		f1 int
+		f6 []any
+		F3 string
+		f7 *string
+		F4 byte
+		f5 string
+	}
 )
 
 type testNode struct {
@@ -97,6 +125,137 @@ func (l *lst) push() *testNode {
 	return el
 }
 
+type testSerializable uint16
+
+func (s testSerializable) Serialize() []byte {
+	return []byte{byte(s >> 8), byte(s)}
+}
+
+func (s testSerializable) Unserialize(data []byte) (any, error) {
+	if len(data) != 2 {
+		return nil, fmt.Errorf("invalid data length %d", len(data))
+	}
+	return uint16(data[0])<<8 | uint16(data[1]), nil
+}
+
+type testPtrSerializable struct {
+	name string
+	tags []string
+}
+
+func (s *testPtrSerializable) Serialize() []byte {
+	return Serialize([]any{s.name, s.tags})
+}
+
+func (s *testPtrSerializable) Unserialize(data []byte) (any, error) {
+	v, err := Unserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := v.([]any)
+	s.name = fields[0].(string)
+	s.tags = fields[1].([]string)
+	return s, nil
+}
+
+type testBinaryMarshaler struct {
+	n    uint8
+	name string
+}
+
+func (m testBinaryMarshaler) MarshalBinary() ([]byte, error) {
+	if m.name == "" {
+		return nil, fmt.Errorf("empty name")
+	}
+	return append([]byte{m.n}, m.name...), nil
+}
+
+func (m *testBinaryMarshaler) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("invalid data length %d", len(data))
+	}
+	m.n = data[0]
+	m.name = string(data[1:])
+	return nil
+}
+
+type testGobEncoder struct {
+	n uint8
+}
+
+func (e *testGobEncoder) GobEncode() ([]byte, error) {
+	return []byte{e.n}, nil
+}
+
+func (e *testGobEncoder) GobDecode(data []byte) error {
+	if len(data) != 1 {
+		return fmt.Errorf("invalid data length %d", len(data))
+	}
+	e.n = data[0]
+	return nil
+}
+
+// methods promoted from embedded fields do not make the struct a marshaler
+type testEmbeddedMarshaler struct {
+	testBinaryMarshaler
+	Name string
+}
+
+type testEmbeddedTime struct {
+	time.Time
+	Name string
+}
+
+type testCodecMarshaler struct {
+	name   string
+	items  []int
+	parent *testCodecMarshaler
+	shared *int
+}
+
+type testCodecHolder struct {
+	m testCodecMarshaler
+	n int
+	p *testCodecHolder
+}
+
+func (m *testCodecMarshaler) MarshalCodec(e *Encoder) error {
+	if m.name == "" {
+		return fmt.Errorf("empty name")
+	}
+	for _, v := range []any{m.name, m.items, m.parent, m.shared} {
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *testCodecMarshaler) UnmarshalCodec(d *Decoder) error {
+	for _, ptr := range []any{&m.name, &m.items, &m.parent, &m.shared} {
+		if err := d.DecodeInto(ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type testRequest struct {
+	Id      int64
+	Method  string
+	Tags    []string
+	Headers map[string]string
+	Items   []testRequestItem
+	Parent  *testRequest
+}
+
+type testRequestItem struct {
+	Name   string
+	Price  float64
+	Amount int32
+	Valid  bool
+}
+
 // End test types
 
 func TestTypeIdByValue(t *testing.T) {
@@ -127,3 +286,92 @@ func TestTypeIdByValue(t *testing.T) {
 		}
 	}
 }
+
+func TestTypeRegistryManifest(t *testing.T) {
+	reg := NewTypeRegistry(true)
+	reg.RegisterBaseTypes()
+	reg.RegisterTypeOf(testStruct6{})
+	reg.RegisterTypeOf([]any{})
+	reg.RegisterFunc(fmt.Sprint)
+	buf := &bytes.Buffer{}
+	if err := reg.WriteManifest(buf); err != nil {
+		t.Fatalf("WriteManifest() raises error: %q", err)
+	}
+	manifest := buf.String()
+
+	loaded, err := LoadTypeRegistry(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("LoadTypeRegistry() raises error: %q", err)
+	}
+	if !reflect.DeepEqual(reg.RegisteredTypeNames(), loaded.RegisteredTypeNames()) {
+		t.Errorf("RegisteredTypeNames() of loaded registry must return %v, but actual value is %v", reg.RegisteredTypeNames(), loaded.RegisteredTypeNames())
+	}
+	loaded.RegisterFunc(fmt.Sprint)
+	loaded.RegisterTypeOf([]any{})
+	loaded.RegisterTypeOf(testStruct7{})
+	for i, v := range []any{nil, 1, []any{}, testStruct6{}, fmt.Sprint} {
+		expected := reg.typeIdByValue(reflect.ValueOf(v))
+		if actual := loaded.typeIdByValue(reflect.ValueOf(v)); actual != expected {
+			t.Errorf("Test #%d: type id of %T must be %d, but actual value is %d", i+1, v, expected, actual)
+		}
+	}
+	if expected, actual := reg.nextId, loaded.typeIdByValue(reflect.ValueOf(testStruct7{})); actual != expected {
+		t.Errorf("new type must get id %d, but actual value is %d", expected, actual)
+	}
+
+	pinned, _ := LoadTypeRegistry(strings.NewReader(manifest))
+	pinned.TurnOffTypeAutoRegistration()
+	expected := []any{testStruct6{f1: 1, F3: "a"}}
+	data := Serialize(expected, reg)
+	if actual, err := Unserialize(data, pinned); err == nil {
+		t.Errorf("Unserialize() must return error for unbound types, but actual value is %v", actual)
+	}
+	if actual, err := TrySerialize(expected, pinned); err != nil || !bytes.Equal(data, actual) {
+		t.Errorf("TrySerialize(%v) with pinned types must return %v, but actual value is %v (err: %v)", expected, data, actual, err)
+	}
+	if actual, err := Unserialize(data, pinned); err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Unserialize(%v) returns wrong value %v (err: %v)", data, actual, err)
+	}
+
+	removed, _ := LoadTypeRegistry(strings.NewReader(`{"nextId": 30, "types": {"bool": 2}}`))
+	removed.RegisterTypeOf(testStruct6{})
+	if id := removed.typeIdByValue(reflect.ValueOf(testStruct6{})); id < 30 {
+		t.Errorf("new type must get id not less than %d, but actual value is %d", 30, id)
+	}
+
+	invalid := []string{
+		`{"types": {"bool": 0}}`,
+		`{"types": {"bool": 1, "int": 1}}`,
+		`{"types": {"a": 1}, "funcs": {"a": 2}}`,
+		`{"types": []}`,
+	}
+	for i, manifest := range invalid {
+		if _, err := LoadTypeRegistry(strings.NewReader(manifest)); err == nil {
+			t.Errorf("Test #%d: LoadTypeRegistry(%s) must return error", i+1, manifest)
+		}
+	}
+}
+
+func TestTypeRegistryPlans(t *testing.T) {
+	reg := NewTypeRegistry(true)
+	typ := reflect.TypeOf(testStruct6{})
+	p := reg.planOf(typ)
+	if p != reg.planOf(typ) {
+		t.Errorf("planOf(%s) must return the cached plan", typ)
+	}
+	if p.name != reflex.NameOf(typ) || p.marshaler != noMarshaler || len(p.fields.fields) != 5 || len(p.fields.named) != 5 {
+		t.Errorf("planOf(%s) returns wrong plan %+v", typ, p)
+	}
+	id := reg.typeIdByValue(reflect.ValueOf(testStruct6{}))
+	if int(p.id.Load()) != id {
+		t.Errorf("type id %d must be cached in the plan, but actual id is %d", id, p.id.Load())
+	}
+
+	reg.RegisterCodec(typ, func(any) ([]byte, error) { return nil, nil }, func([]byte) (any, error) { return testStruct6{}, nil })
+	if p = reg.planOf(typ); p.marshaler != registryCodec {
+		t.Errorf("plan of %s must be recompiled after codec registration", typ)
+	}
+	if actual := reg.typeIdByValue(reflect.ValueOf(testStruct6{})); actual != id {
+		t.Errorf("type id of %s must not change, but actual id is %d", typ, actual)
+	}
+}
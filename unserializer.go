@@ -1,6 +1,9 @@
 package codec
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
 	"fmt"
 	"io"
 	"math"
@@ -11,37 +14,82 @@ import (
 	"github.com/URALINNOVATSIYA/reflex"
 )
 
+const minBufferSize = 4096 // minimum size of the buffer for data read from a stream
+
 type forwardPtr struct {
-	cntrId   int
+	ptr      reflect.Value // pointer to a value that is not decoded yet
 	elemId   int
 	elemType reflect.Type
+	copies   []reflect.Value // values that hold copies of the pointer (interfaces, map entries, etc.)
+}
+
+type fieldMigration struct {
+	from, to reflect.Value
+}
+
+type mapEntry struct {
+	m, key, value reflect.Value
+}
+
+// decoders contains decoding functions of the supported encoding versions
+var decoders = map[byte]func(u *Unserializer) reflect.Value{
+	version1: decodeV1,
+	version:  (*Unserializer).decode,
 }
 
 type Unserializer struct {
-	typeRegistry *TypeRegistry
-	id           int
-	pos          int
-	size         int
-	data         []byte
-	values       map[int]reflect.Value
-	forwardPtrs  map[int]forwardPtr
+	typeRegistry     *TypeRegistry
+	structCodingMode StructCodingMode
+	limits           Limits
+	id               int
+	r                io.Reader // source of data when it is decoded from a stream
+	offset           int       // offset of the first byte of data in the stream
+	start            int       // offset of the value being decoded in the stream
+	pos              int
+	size             int
+	data             []byte
+	values           map[int]reflect.Value
+	forwardPtrs      map[int]forwardPtr
+	forwardAnys      map[*any]int // ids of the forward pointers held by interfaces of type any
+	mapEntries       []mapEntry
+	spare            int // memory allocated for capacities of slices and channels exceeding their lengths
+	migrations       []fieldMigration
+	path             []reflect.Type       // types of the values being decoded
+	namedTypes       map[int]reflect.Type // types by ids of data with type names
+	root             reflect.Value        // caller-owned value the data is decoded into
 }
 
 func NewUnserializer() *Unserializer {
 	return &Unserializer{
 		typeRegistry: GetDefaultTypeRegistry(),
+		limits:       DefaultLimits,
 	}
 }
 
 func (u *Unserializer) WithOptions(options []any) *Unserializer {
+	if err := u.applyOptions(options); err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// applyOptions configures the unserializer with the options, it returns an error if an option is not supported
+func (u *Unserializer) applyOptions(options []any) error {
 	for _, option := range options {
-		if v, ok := option.(*TypeRegistry); ok {
+		switch v := option.(type) {
+		case *TypeRegistry:
 			u.WithTypeRegistry(v)
-			continue
+		case StructCodingMode:
+			u.WithStructCodingMode(v)
+		case Limits:
+			u.WithLimits(v)
+		case TypeIdMode:
+			// type ids of any mode are decoded
+		default:
+			return fmt.Errorf("invalid option type %T", option)
 		}
-		panic(fmt.Errorf("invalid option type %T", option))
 	}
-	return u
+	return nil
 }
 
 func (u *Unserializer) WithTypeRegistry(registry *TypeRegistry) *Unserializer {
@@ -49,30 +97,105 @@ func (u *Unserializer) WithTypeRegistry(registry *TypeRegistry) *Unserializer {
 	return u
 }
 
+func (u *Unserializer) WithStructCodingMode(mode StructCodingMode) *Unserializer {
+	u.structCodingMode = mode
+	return u
+}
+
+func (u *Unserializer) WithLimits(limits Limits) *Unserializer {
+	u.limits = limits.withDefaults()
+	return u
+}
+
 func (u *Unserializer) Decode(data []byte) (value any, err error) {
-	if data == nil {
-		return nil, io.ErrUnexpectedEOF
-	}
-	//defer func() {
-	//	if e := recover(); e != nil {
-	//		err = fmt.Errorf("%s", e)
-	//	}
-	//}()
-	u.id = 0
-	u.pos = 1 // skip version for now
+	u.r = nil
+	u.offset = 0
+	u.pos = 0
 	u.data = data
 	u.size = len(data)
-	u.values = make(map[int]reflect.Value)
+	return u.decodeData()
+}
+
+// decodeData decodes a value starting from the current position
+func (u *Unserializer) decodeData() (value any, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			value, err = nil, &DecodeError{
+				Err:    errorOf(e),
+				Offset: u.offset + u.pos,
+				NodeId: u.id - 1,
+				Path:   typePath(u.path),
+			}
+		}
+	}()
+	u.id = 0
+	u.start = u.offset + u.pos
+	if u.values == nil {
+		u.values = make(map[int]reflect.Value)
+	} else {
+		clear(u.values) // keeps the memory allocated for the values of the previous data
+	}
 	u.forwardPtrs = make(map[int]forwardPtr)
-	if v := u.decode(); v.IsValid() {
+	u.forwardAnys = nil
+	u.mapEntries = nil
+	u.spare = 0
+	u.migrations = nil
+	u.path = u.path[:0]
+	if u.r == nil {
+		checkLimit("data size", u.size, u.limits.MaxBytes)
+	}
+	v := u.readByte()
+	u.namedTypes = nil
+	if v&typeNames != 0 && v&^typeNames == version {
+		u.namedTypes = make(map[int]reflect.Type)
+		v = version
+	}
+	decode, exists := decoders[v]
+	if !exists {
+		panic(fmt.Errorf("%w: unsupported version %d", ErrVersionMismatch, v))
+	}
+	if v := decode(u); v.IsValid() && !u.root.IsValid() {
 		return v.Interface(), nil
 	}
 	return value, err
 }
 
+// DecodeInto decodes data directly into the value ptr points to.
+// The type of the encoded value must be the type of the value (or implement it if it is an interface),
+// otherwise an error wrapping ErrTypeMismatch is returned. The type of the encoded value is not required
+// to be registered, if it is the type of the value. If an error occurs, the value may be partially decoded.
+func (u *Unserializer) DecodeInto(data []byte, ptr any) error {
+	if err := u.setRoot(ptr); err != nil {
+		return err
+	}
+	defer u.setRoot(nil)
+	_, err := u.Decode(data)
+	return err
+}
+
+func (u *Unserializer) setRoot(ptr any) error {
+	if ptr == nil {
+		u.root = reflect.Value{}
+		return nil
+	}
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("%w: value of type %T cannot be decoded into, non-nil pointer is required", ErrTypeMismatch, ptr)
+	}
+	u.root = v.Elem()
+	return nil
+}
+
 func (u *Unserializer) decode() reflect.Value {
-	v := u.decodeNode(-1)
+	var v reflect.Value
+	if u.root.IsValid() {
+		v = u.decodeRoot(u.root)
+	} else {
+		v = u.decodeNode()
+	}
 	u.restoreForwarPointers()
+	u.migrateFields()
+	u.restoreMapEntries()
 	return v
 }
 
@@ -81,100 +204,152 @@ func (u *Unserializer) decodeId() int {
 }
 
 func (u *Unserializer) decodeLength() int {
-	return int(u.decodeCount(4))
+	return u.decodeSize("length", u.limits.MaxLength)
 }
 
-func (u *Unserializer) decodeType() reflect.Type {
-	return u.typeRegistry.typeById(int(u.decodeCount(3)))
+// decodeElementCount decodes the number of elements of a collection. Every element takes at least one byte,
+// so data decoded from a byte slice cannot contain more elements than the bytes left.
+func (u *Unserializer) decodeElementCount() int {
+	return u.checkElementCount(u.decodeLength())
 }
 
-func (u *Unserializer) decodeNode(parentContainerId int) reflect.Value {
-	if u.top() == meta_ref {
-		return u.decodeReference(nil, parentContainerId)
+func (u *Unserializer) checkElementCount(count int) int {
+	if u.r == nil && count > u.size-u.pos {
+		panic(ErrUnexpectedEOF)
+	}
+	return count
+}
+
+// sizeHint returns the number of elements to allocate memory for before they are decoded.
+// Elements read from a stream may not exist, so memory is allocated for the buffered bytes at most.
+func (u *Unserializer) sizeHint(count int) int {
+	if u.r == nil {
+		return count
+	}
+	return min(count, max(u.size-u.pos, minBufferSize))
+}
+
+// spareCapacity returns the part of the capacity exceeding the length of a slice that can be allocated.
+// It is not backed by data, so it is restored while the memory allocated for such capacities
+// does not exceed the data size (or spareMemory for small data), and the rest is dropped.
+func (u *Unserializer) spareCapacity(elemType reflect.Type, capacity int) int {
+	if size := int(elemType.Size()); size > 0 {
+		capacity = max(min(capacity, (u.spareLimit()-u.spare)/size), 0)
+		u.spare += capacity * size
+	}
+	return capacity
+}
+
+// checkSpareCapacity panics if memory allocated for the capacity of a channel exceeds the data size
+// (or spareMemory for small data), since the capacity is not backed by data
+func (u *Unserializer) checkSpareCapacity(name string, elemType reflect.Type, capacity int) {
+	if size := int(elemType.Size()); size > 0 {
+		if limit := u.spareLimit(); capacity > (limit-u.spare)/size {
+			panic(fmt.Errorf("%w: %s is %d, but memory is left for %d", ErrLimitExceeded, name, capacity, (limit-u.spare)/size))
+		}
+		u.spare += capacity * size
+	}
+}
+
+func (u *Unserializer) spareLimit() int {
+	return max(u.offset+u.pos-u.start, spareMemory)
+}
+
+func (u *Unserializer) decodeSize(name string, limit int) int {
+	size := u.decodeCount(4)
+	if size > math.MaxInt {
+		panic(fmt.Errorf("%w: %s is %d", ErrLimitExceeded, name, size))
 	}
+	checkLimit(name, int(size), limit)
+	return int(size)
+}
+
+func (u *Unserializer) decodeType() reflect.Type {
+	id := int(u.decodeCount(3))
+	if u.namedTypes == nil {
+		return u.typeRegistry.typeById(id)
+	}
+	t, exists := u.namedTypes[id]
+	if !exists {
+		t = u.typeRegistry.typeByName(string(u.readBytes(u.decodeLength())))
+		u.namedTypes[id] = t
+	}
+	return t
+}
+
+func (u *Unserializer) decodeNode() reflect.Value {
 	t := u.decodeType()
-	return u.decodeValue(t, reflex.Zero(t), parentContainerId)
+	return u.decodeValue(t, reflex.Zero(t))
+}
+
+// decodeRoot decodes the root value directly into the caller-owned value v
+func (u *Unserializer) decodeRoot(v reflect.Value) reflect.Value {
+	expected := v.Type()
+	t := u.decodeRootType(expected)
+	switch {
+	case t == expected:
+		u.decodeValueAt(t, v)
+	case t == nil && isNillable(expected):
+		u.decodeValue(t, reflect.Value{})
+		v.SetZero()
+	case t != nil && expected.Kind() == reflect.Interface && t.AssignableTo(expected):
+		v.Set(u.decodeValue(t, reflex.Zero(t)))
+	default:
+		panic(typeMismatchError(expected, t))
+	}
+	return v
+}
+
+// decodeRootType reads type of the root value. Unregistered type is considered as the expected type.
+func (u *Unserializer) decodeRootType(expected reflect.Type) reflect.Type {
+	id := int(u.decodeCount(3))
+	if u.namedTypes != nil {
+		t := expected
+		if name := string(u.readBytes(u.decodeLength())); name != reflex.NameOf(expected) {
+			t = u.typeRegistry.typeByName(name)
+		}
+		u.namedTypes[id] = t
+		return t
+	}
+	if t, exists := u.typeRegistry.lookupType(id); exists {
+		return t
+	}
+	if expected.Kind() == reflect.Interface {
+		panic(fmt.Errorf("%w: %d", ErrUnknownTypeId, id))
+	}
+	return expected
 }
 
 func (u *Unserializer) decodeContainer(containerType reflect.Type, containerValue reflect.Value) {
 	containerValue = reflex.PtrAt(containerType, containerValue).Elem()
 	u.values[u.id] = containerValue
 	u.id++
-	v := u.decodeValue(containerType, reflex.Zero(containerType), u.id-1)
-	if v.IsValid() {
-		containerValue.Set(v)
+	u.decodeValueAt(containerType, containerValue)
+}
+
+// decodeValueAt decodes value directly into v, so that pointers to v remain valid
+func (u *Unserializer) decodeValueAt(t reflect.Type, v reflect.Value) {
+	if value := u.decodeValue(t, v); value.IsValid() {
+		v.Set(value)
 	}
 }
 
-func (u *Unserializer) decodeValue(t reflect.Type, v reflect.Value, parentContainerId int) reflect.Value {
-	kind := v.Kind()
-	switch kind {
-	case reflect.Invalid:
+func (u *Unserializer) decodeValue(t reflect.Type, v reflect.Value) reflect.Value {
+	u.path = append(u.path, t)
+	checkLimit("depth", len(u.path), u.limits.MaxDepth)
+	checkLimit("node count", u.id+1, u.limits.MaxNodes)
+	v = u.decodeValueOf(t, v)
+	u.path = u.path[:len(u.path)-1]
+	return v
+}
+
+func (u *Unserializer) decodeValueOf(t reflect.Type, v reflect.Value) reflect.Value {
+	if t == nil {
 		u.decodeNil()
-	case reflect.Bool:
-		u.decodeBool(v)
-	case reflect.Uint8:
-		u.decodeUint8(v)
-	case reflect.Int8:
-		u.decodeInt8(v)
-	case reflect.Uint16:
-		u.decodeUint16(v)
-	case reflect.Int16:
-		u.decodeInt16(v)
-	case reflect.Uint32:
-		u.decodeUint32(v)
-	case reflect.Int32:
-		u.decodeInt32(v)
-	case reflect.Uint64:
-		u.decodeUint64(v)
-	case reflect.Int64:
-		u.decodeInt64(v)
-	case reflect.Uint:
-		u.decodeUint(v)
-	case reflect.Int:
-		u.decodeInt(v)
-	case reflect.Float32:
-		u.decodeFloat32(v)
-	case reflect.Float64:
-		u.decodeFloat64(v)
-	case reflect.Complex64:
-		u.decodeComplex64(v)
-	case reflect.Complex128:
-		u.decodeComplex128(v)
-	case reflect.Uintptr:
-		u.decodeUintptr(v)
-	case reflect.UnsafePointer:
-		u.decodeUnsafePointer(v)
-	default:
-		if u.top() == meta_ref {
-			return u.decodeReference(t, parentContainerId)
-		}
-		u.values[u.id] = v
 		u.id++
-		switch kind {
-		case reflect.String:
-			u.decodeString(v)
-		case reflect.Chan:
-			u.decodeChan(v)
-		case reflect.Func:
-			u.decodeFunc(v)
-		case reflect.Array:
-			//u.decodeArray(t.Elem(), v)
-		case reflect.Slice:
-			//u.decodeList(t.Elem(), v)
-		case reflect.Map:
-			//u.decodeMap(t.Key(), t.Elem(), v)
-		case reflect.Struct:
-			u.decodeStruct(v)
-		case reflect.Interface:
-			u.decodeInterface(v, parentContainerId)
-		case reflect.Pointer:
-			u.decodePointer(t.Elem(), v, parentContainerId)
-		}
 		return v
 	}
-	u.id++
-	return v
+	return u.typeRegistry.planOf(t).decode(u, t, v)
 }
 
 func (u *Unserializer) decodeNil() {
@@ -269,8 +444,9 @@ func (u *Unserializer) decodeChan(v reflect.Value) {
 	if u.readByte() == meta_nil {
 		return
 	}
-	cap := u.decodeLength()
+	cap := u.decodeSize("channel capacity", u.limits.MaxChanCapacity)
 	t := v.Type()
+	u.checkSpareCapacity("channel capacity", t.Elem(), cap)
 	if t.ChanDir() == reflect.BothDir {
 		v.Set(reflect.MakeChan(t, cap))
 	} else {
@@ -289,143 +465,278 @@ func (u *Unserializer) decodeFunc(v reflect.Value) {
 }
 
 func (u *Unserializer) decodeList(elemType reflect.Type, v reflect.Value) {
-	/*meta := u.readByte()
-	if meta&meta_nil != 0 {
+	if u.readByte() == meta_nil {
 		return
 	}
-	length := u.decodeLength()
-	if meta&meta_fixed == 0 {
-		v.Set(reflect.MakeSlice(v.Type(), length, length))
-	}
-	var refs []int
-	refcnt := u.decodeLength()
-	for i := 0; i < refcnt; i++ {
-		refs = append(refs, u.decodeLength())
-	}
-	for i, j := 0, 0; i < length; i++ {
-		elemValue := v.Index(i)
-		if j < refcnt && refs[j] == i {
-			u.saveRef(elemValue)
-			fmt.Printf("cnt=%d: %s\n", u.cnt, reflex.NameOf(elemType))
-			ref, cnt := u.decodeReference()
-			elemValue.Set(ref)
-
-			var value reflect.Value = elemValue
-			for k := uint32(cnt - 1); k != 0; k-- {
-				ref := u.refs[k]
-				switch ref.Kind() {
-				case reflect.Pointer:
-					ref.Set(u.ptrTo(ref.Type().Elem(), elemValue))
-				default:
-					ref.Set(value)
-				}
-				value = ref
-			}
+	length := u.decodeElementCount()
+	capacity := u.decodeLength()
+	if capacity < length {
+		panic(fmt.Errorf("slice capacity %d is less than its length %d", capacity, length))
+	}
+	v.Set(reflect.MakeSlice(v.Type(), length, length+u.spareCapacity(elemType, capacity-length)))
+	for i := 0; i < length; i++ {
+		u.decodeContainer(elemType, v.Index(i))
+	}
+}
 
-			j++
-		} else {
-			u.populateValue(elemType, elemValue)
-		}
-	}*/
+func (u *Unserializer) decodeArray(elemType reflect.Type, v reflect.Value) {
+	_ = u.readByte() // skip container mark
+	for i, length := 0, v.Len(); i < length; i++ {
+		u.decodeContainer(elemType, v.Index(i))
+	}
 }
 
 func (u *Unserializer) decodeMap(keyType reflect.Type, valueType reflect.Type, v reflect.Value) {
-	/*meta := u.readByte()
-	if meta&meta_nil != 0 {
+	if u.readByte() == meta_nil {
 		return
 	}
-	length := u.decodeLength()
-	v.Set(reflect.MakeMapWithSize(v.Type(), length))
-	var refs []int
-	var reftps []byte
-	refcnt := u.decodeLength()
-	for i := 0; i < refcnt; i++ {
-		reftps = append(reftps, u.readByte())
-		refs = append(refs, u.decodeLength())
-	}
-	var key, value reflect.Value
-	for i, j := 0, 0; i < length; i++ {
-		if j < refcnt && refs[j] == i {
-			if reftps[j]&0b01 != 0 {
-				key, _ = u.decodeReference()
-			} else {
-				key = u.decodeValue(keyType)
-			}
-			if reftps[j]&0b10 != 0 {
-				value, _ = u.decodeReference()
-			} else {
-				value = u.decodeValue(valueType)
+	length := u.decodeElementCount()
+	v.Set(reflect.MakeMapWithSize(v.Type(), u.sizeHint(length)))
+	for i := 0; i < length; i++ {
+		key := reflex.Zero(keyType)
+		u.decodeValueAt(keyType, key)
+		value := reflex.Zero(valueType)
+		u.decodeValueAt(valueType, value)
+		// keys and values can contain forward pointers, so entries are added after decoding
+		u.mapEntries = append(u.mapEntries, mapEntry{v, key, value})
+	}
+}
+
+func (u *Unserializer) decodeStruct(fields structFields, v reflect.Value) {
+	_ = u.readByte() // skip container mark
+	if u.structCodingMode == StructCodingModeName {
+		for i, count := 0, u.decodeLength(); i < count; i++ {
+			name := string(u.readBytes(u.decodeLength()))
+			idCount, size := u.decodeSize("node count", u.limits.MaxNodes), u.decodeLength()
+			f, exists := fields.fieldByName(name)
+			if !exists {
+				// the field is removed from the struct, references to its values are bad
+				u.id += idCount
+				u.discard(size)
+				continue
 			}
-			j++
-		} else {
-			key = u.decodeValue(keyType)
-			value = u.decodeValue(valueType)
+			u.decodeField(v, f)
+		}
+		return
+	}
+	count := len(fields.fields)
+	if fields.tagged {
+		// payloads encoded before new fields were added contain fewer fields
+		if count = u.decodeLength(); count > len(fields.fields) {
+			panic(fmt.Errorf("struct %s has %d encoded fields, but only %d fields are known", v.Type(), count, len(fields.fields)))
 		}
-		v.SetMapIndex(key, value)
-	}*/
+	}
+	for _, f := range fields.fields[:count] {
+		u.decodeField(v, f)
+	}
 }
 
-func (u *Unserializer) decodeStruct(v reflect.Value) {
-	_ = u.readByte() // skip container mark
-	for i, count := 0, v.NumField(); i < count; i++ {
-		field := v.Field(i)
+func (u *Unserializer) decodeField(v reflect.Value, f structField) {
+	field := v.Field(f.index)
+	if !f.isSuperseded() {
 		u.decodeContainer(field.Type(), field)
+		return
+	}
+	value := reflex.Zero(field.Type())
+	u.decodeContainer(field.Type(), value)
+	if f.migratedTo >= 0 {
+		to := v.Field(f.migratedTo)
+		// values of the fields are converted after all pointers are restored
+		u.migrations = append(u.migrations, fieldMigration{value, reflex.PtrAt(to.Type(), to).Elem()})
 	}
 }
 
-func (u *Unserializer) decodeInterface(v reflect.Value, parentContainerId int) {
-	elem := u.decodeNode(parentContainerId)
+func (u *Unserializer) decodeInterface(v reflect.Value) {
+	elemId := u.id
+	elem := u.decodeNode()
 	if elem.IsValid() {
+		if !elem.Type().AssignableTo(v.Type()) {
+			panic(typeMismatchError(v.Type(), elem.Type()))
+		}
 		v.Set(elem)
 	}
+	u.copyForwardPtr(elemId, v)
 }
 
-func (u *Unserializer) decodePointer(elemType reflect.Type, v reflect.Value, parentContainerId int) {
+func (u *Unserializer) decodePointer(elemType reflect.Type, v reflect.Value) {
 	if u.readByte() == meta_nil {
 		return
 	}
 	elemValue := reflex.Zero(elemType)
 	v.Set(reflex.PtrAt(elemType, elemValue))
-	elemValue = u.decodeValue(elemType, elemValue, parentContainerId)
-	if !elemValue.IsValid() {
+	if u.top() == meta_ref {
+		u.decodePointedReference(elemType, v)
+	} else {
+		u.decodeValue(elemType, elemValue)
+	}
+}
+
+// decodeReference decodes a reference to the value that has been already decoded
+func (u *Unserializer) decodeReference(t reflect.Type, v reflect.Value) reflect.Value {
+	id, value, exists := u.readReference(t)
+	if !exists {
+		panic(fmt.Errorf("%w: node #%d is not decoded yet", ErrBadReference, id))
+	}
+	if u.copyForwardPtr(id, v) {
+		return reflect.Value{}
+	}
+	if !value.Type().AssignableTo(t) {
+		panic(typeMismatchError(t, value.Type()))
+	}
+	return value
+}
+
+// decodePointedReference decodes a reference to the value the pointer ptr points to
+func (u *Unserializer) decodePointedReference(elemType reflect.Type, ptr reflect.Value) {
+	ptrId := u.id - 1
+	id, elemValue, exists := u.readReference(elemType)
+	if !exists {
+		u.forwardPtrs[ptrId] = forwardPtr{
+			ptr:      ptr,
+			elemId:   id,
+			elemType: elemType,
+		}
 		return
 	}
-	u.setPtrValue(v, elemType, elemValue)
+	if elemType.Kind() == reflect.Interface && elemValue.Kind() != reflect.Interface {
+		// the pointer points to an interface that holds the referenced value
+		if u.copyForwardPtr(id, ptr.Elem()) {
+			return
+		}
+	}
+	u.setPtrValue(ptr, elemType, elemValue)
 }
 
-func (u *Unserializer) decodeReference(elemType reflect.Type, parentContainerId int) reflect.Value {
+func (u *Unserializer) readReference(t reflect.Type) (id int, value reflect.Value, exists bool) {
 	_ = u.readByte() // skip reference indicator
-	id := u.decodeId()
-	if v, exists := u.values[id]; exists {
-		u.id++
-		if ptr, exists := u.forwardPtrs[id]; exists {
-			return u.registerForwardPtr(u.id-2, parentContainerId, ptr.elemId, ptr.elemType)
+	id = u.decodeId()
+	value, exists = u.values[id]
+	if exists && t.Kind() == reflect.Interface && value.Kind() != reflect.Interface {
+		u.id++ // the referenced value is held by an interface node
+	}
+	return
+}
+
+// copyForwardPtr registers v as a holder of a copy of the pointer with the given id
+// if the pointer is not restored yet
+func (u *Unserializer) copyForwardPtr(ptrId int, v reflect.Value) bool {
+	ptr, exists := u.forwardPtrs[ptrId]
+	if exists {
+		if !ptr.ptr.Type().AssignableTo(v.Type()) {
+			panic(typeMismatchError(v.Type(), ptr.ptr.Type()))
 		}
-		return v
+		ptr.copies = append(ptr.copies, v)
+		u.forwardPtrs[ptrId] = ptr
+		if v.Type() == anyType && v.CanAddr() {
+			if u.forwardAnys == nil {
+				u.forwardAnys = make(map[*any]int)
+			}
+			u.forwardAnys[(*any)(v.Addr().UnsafePointer())] = ptrId
+		}
+	}
+	return exists
+}
+
+// copyForwardAny registers v as a holder of a copy of the pointer held by the interface
+// if the pointer is not restored yet (values read by nested decoders are such interfaces)
+func (u *Unserializer) copyForwardAny(holder *any, v reflect.Value) error {
+	ptrId, exists := u.forwardAnys[holder]
+	if !exists {
+		return nil
 	}
-	if elemType == nil {
-		panic(fmt.Errorf("reference on node #%d is incorrect", id))
+	if t := u.forwardPtrs[ptrId].ptr.Type(); !t.AssignableTo(v.Type()) {
+		return typeMismatchError(v.Type(), t)
 	}
-	return u.registerForwardPtr(u.id-1, parentContainerId, id, elemType)
+	u.copyForwardPtr(ptrId, v)
+	return nil
 }
 
-func (u *Unserializer) registerForwardPtr(ptrId, parentContainerId, elemId int, elemType reflect.Type) reflect.Value {
-	cntrId := ptrId
-	if ptrId == parentContainerId+1 || ptrId == parentContainerId+2 {
-		cntrId = parentContainerId
+func (u *Unserializer) decodeSerializable(p *typePlan, t reflect.Type, v reflect.Value) {
+	switch p.marshaler {
+	case registryCodec:
+		value, err := p.codec.dec(u.readBytes(u.decodeLength()))
+		if err != nil {
+			panic(fmt.Errorf("cannot decode value of type %s: %w", t, err))
+		}
+		setUnmarshaled(t, v, value, "codec")
+	case codecMarshaler:
+		u.decodeCodecMarshaler(t, v)
+	default:
+		unserializeTo(p.marshaler, t, v, u.readBytes(u.decodeLength()))
 	}
-	u.forwardPtrs[ptrId] = forwardPtr{
-		cntrId:   cntrId,
-		elemId:   elemId,
-		elemType: elemType,
+}
+
+// decodeCodecMarshaler decodes the values written by MarshalCodec and passes them to UnmarshalCodec
+func (u *Unserializer) decodeCodecMarshaler(t reflect.Type, v reflect.Value) {
+	values := u.decodeValue(anySliceType, reflex.Zero(anySliceType)).Interface().([]any)
+	obj := reflect.New(t)
+	if v.CanAddr() {
+		obj = reflex.MakeExported(v).Addr()
+	}
+	d := &Decoder{values: values, nested: true, parent: u}
+	err := obj.Interface().(CodecMarshaler).UnmarshalCodec(d)
+	if err != nil {
+		panic(fmt.Errorf("cannot unmarshal value of type %s: %w", t, err))
+	}
+	if !v.CanAddr() {
+		v.Set(obj.Elem())
 	}
-	return reflect.Value{}
+}
+
+// unserializeTo sets v to the value of type t restored from data by marshaler m
+func unserializeTo(m marshaler, t reflect.Type, v reflect.Value, data []byte) {
+	var err error
+	switch m {
+	case binaryMarshaler:
+		obj := reflect.New(t)
+		err = obj.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+		v.Set(obj.Elem())
+	case gobMarshaler:
+		obj := reflect.New(t)
+		err = obj.Interface().(gob.GobDecoder).GobDecode(data)
+		v.Set(obj.Elem())
+	default:
+		unserializeSerializableTo(t, v, data)
+	}
+	if err != nil {
+		panic(fmt.Errorf("cannot unmarshal value of type %s: %w", t, err))
+	}
+}
+
+func unserializeSerializableTo(t reflect.Type, v reflect.Value, data []byte) {
+	obj := reflect.New(t)
+	if t.Implements(serializableInterfaceType) {
+		obj = obj.Elem()
+	}
+	value, err := obj.Interface().(Serializable).Unserialize(data)
+	if err != nil {
+		panic(err)
+	}
+	setUnmarshaled(t, v, value, t.String()+".Unserialize()")
+}
+
+// setUnmarshaled sets v to value (or the value it points to) returned by the unmarshaling function
+func setUnmarshaled(t reflect.Type, v reflect.Value, value any, function string) {
+	elem := reflect.ValueOf(value)
+	if elem.Kind() == reflect.Pointer && !elem.Type().ConvertibleTo(t) {
+		elem = elem.Elem()
+	}
+	if !elem.IsValid() || !elem.Type().ConvertibleTo(t) {
+		panic(fmt.Errorf("%w: %s returns value of type %T", ErrTypeMismatch, function, value))
+	}
+	v.Set(elem.Convert(t))
 }
 
 func (u *Unserializer) decodeCount(sizeBits int) uint64 {
-	cnt, length := bs2u(u.data[u.pos:], sizeBits)
-	if length <= 0 {
-		panic(io.ErrUnexpectedEOF)
+	if u.fill(1) {
+		u.fill(int(u.data[u.pos] >> (8 - sizeBits)))
+	}
+	cnt, length := bs2u(u.data[min(u.pos, u.size):u.size], sizeBits)
+	if length < 0 {
+		panic(ErrUnexpectedEOF)
+	}
+	if length == 0 {
+		panic(fmt.Errorf("malformed count: %#08b", u.data[u.pos]))
 	}
 	u.pos += length
 	return cnt
@@ -433,47 +744,164 @@ func (u *Unserializer) decodeCount(sizeBits int) uint64 {
 
 func (u *Unserializer) restoreForwarPointers() {
 	for _, forwardPtr := range u.forwardPtrs {
-		ptr := u.values[forwardPtr.cntrId]
 		elemValue, exists := u.values[forwardPtr.elemId]
 		if !exists {
-			panic(fmt.Errorf("value #%d is not found", forwardPtr.elemId))
+			panic(fmt.Errorf("%w: node #%d is not found", ErrBadReference, forwardPtr.elemId))
+		}
+		u.setPtrValue(forwardPtr.ptr, forwardPtr.elemType, elemValue)
+		for _, v := range forwardPtr.copies {
+			v.Set(forwardPtr.ptr)
 		}
-		u.setPtrValue(ptr, forwardPtr.elemType, elemValue)
+	}
+}
+
+func (u *Unserializer) migrateFields() {
+	for _, m := range u.migrations {
+		if !m.from.IsZero() && m.from.CanConvert(m.to.Type()) {
+			m.to.Set(m.from.Convert(m.to.Type()))
+		}
+	}
+}
+
+func (u *Unserializer) restoreMapEntries() {
+	for _, entry := range u.mapEntries {
+		entry.m.SetMapIndex(entry.key, entry.value)
 	}
 }
 
 func (u *Unserializer) setPtrValue(ptr reflect.Value, elemType reflect.Type, elemValue reflect.Value) {
-	if elemValue.Kind() == reflect.Pointer && elemType.Kind() == reflect.Interface {
+	if elemType.Kind() == reflect.Interface && elemValue.Kind() != reflect.Interface {
+		if !elemValue.Type().AssignableTo(elemType) {
+			panic(typeMismatchError(elemType, elemValue.Type()))
+		}
 		ptr.Elem().Set(elemValue)
 	} else {
+		// the pointer is set to the memory of the value, so their types must be the same
+		if elemValue.Type() != elemType {
+			panic(typeMismatchError(elemType, elemValue.Type()))
+		}
 		ptr.Set(reflex.PtrAt(elemType, elemValue))
 	}
 }
 
 func (u *Unserializer) top() byte {
+	if !u.fill(1) {
+		panic(ErrUnexpectedEOF)
+	}
 	return u.data[u.pos]
 }
 
 func (u *Unserializer) readByte() byte {
+	b := u.top()
 	u.pos++
-	if u.pos > u.size {
-		panic(io.ErrUnexpectedEOF)
-	}
-	return u.data[u.pos-1]
+	return b
 }
 
+// readBytes returns the next count bytes of data.
+// Bytes read from a stream are copied, since the buffer is reused by subsequent reads.
 func (u *Unserializer) readBytes(count int) []byte {
+	if u.r != nil && count > len(u.data) {
+		return u.readLongBytes(count)
+	}
+	if count < 0 || !u.fill(count) {
+		panic(ErrUnexpectedEOF)
+	}
 	u.pos += count
-	if u.pos > u.size {
-		panic(io.ErrUnexpectedEOF)
+	if u.r != nil {
+		return bytes.Clone(u.data[u.pos-count : u.pos])
 	}
 	return u.data[u.pos-count : u.pos]
 }
 
+// readLongBytes reads from the stream count bytes that do not fit the buffer.
+// The bytes are read in chunks, so memory is not allocated for the bytes that the stream does not contain.
+func (u *Unserializer) readLongBytes(count int) []byte {
+	checkLimit("data size", u.offset+u.pos+count-u.start, u.limits.MaxBytes)
+	b := bytes.NewBuffer(make([]byte, 0, len(u.data)))
+	b.Write(u.data[u.pos:u.size])
+	n, err := io.CopyN(b, u.r, int64(count-b.Len()))
+	u.offset += u.size + int(n)
+	u.pos = 0
+	u.size = 0
+	if err == io.EOF {
+		panic(ErrUnexpectedEOF)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return b.Bytes()
+}
+
+// skip discards the next count bytes of data regardless of the data size limit
+func (u *Unserializer) skip(count int) {
+	for u.start = u.offset + u.pos; count > 0 && u.fill(1); u.start = u.offset + u.pos {
+		n := min(count, u.size-u.pos)
+		u.pos += n
+		count -= n
+	}
+	if count > 0 {
+		panic(ErrUnexpectedEOF)
+	}
+}
+
+// discard skips count bytes of the decoded data
+func (u *Unserializer) discard(count int) {
+	for count > 0 && u.fill(1) {
+		n := min(count, u.size-u.pos)
+		u.pos += n
+		count -= n
+	}
+	if count > 0 {
+		panic(ErrUnexpectedEOF)
+	}
+}
+
+// fill reports whether count bytes are available for reading,
+// reading missing bytes from the stream if data is decoded from a stream
+func (u *Unserializer) fill(count int) bool {
+	if u.size-u.pos >= count {
+		return true
+	}
+	if u.r == nil {
+		return false
+	}
+	checkLimit("data size", u.offset+u.pos+count-u.start, u.limits.MaxBytes)
+	// the last read byte is kept, since the decoder of version 1 looks back at it
+	if keep := u.pos - 1; keep > 0 {
+		u.size = copy(u.data, u.data[keep:u.size])
+		u.pos -= keep
+		u.offset += keep
+	}
+	if required := u.pos + count; required > len(u.data) {
+		data := make([]byte, max(required, 2*len(u.data), minBufferSize))
+		copy(data, u.data[:u.size])
+		u.data = data
+	}
+	n, err := io.ReadAtLeast(u.r, u.data[u.size:], u.pos+count-u.size)
+	u.size += n
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		panic(err)
+	}
+	return u.size-u.pos >= count
+}
+
 func Unserialize(data []byte, options ...any) (any, error) {
-	return NewUnserializer().
-		WithOptions(options).
-		Decode(data)
+	u := NewUnserializer()
+	if err := u.applyOptions(options); err != nil {
+		return nil, err
+	}
+	return u.Decode(data)
+}
+
+// UnserializeAs decodes data into a value of type T (see Unserializer.DecodeInto)
+func UnserializeAs[T any](data []byte, options ...any) (T, error) {
+	var v T
+	u := NewUnserializer()
+	if err := u.applyOptions(options); err != nil {
+		return v, err
+	}
+	err := u.DecodeInto(data, &v)
+	return v, err
 }
 
 /*import (
@@ -0,0 +1,543 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"reflect"
+	"unsafe"
+
+	"github.com/URALINNOVATSIYA/reflex"
+)
+
+// v1BaseTypes contains the types which values are encoded in version 1 without type id
+var v1BaseTypes = map[byte]reflect.Type{
+	tBool:           reflect.TypeOf(false),
+	tString:         reflect.TypeOf(""),
+	tInt8:           reflect.TypeOf(uint8(0)),
+	tInt8 | signed:  reflect.TypeOf(int8(0)),
+	tInt16:          reflect.TypeOf(uint16(0)),
+	tInt16 | signed: reflect.TypeOf(int16(0)),
+	tInt32:          reflect.TypeOf(uint32(0)),
+	tInt32 | signed: reflect.TypeOf(int32(0)),
+	tInt64:          reflect.TypeOf(uint64(0)),
+	tInt64 | signed: reflect.TypeOf(int64(0)),
+	tInt:            reflect.TypeOf(uint(0)),
+	tInt | signed:   reflect.TypeOf(0),
+	tFloat:          reflect.TypeOf(float32(0)),
+	tFloat | wide:   reflect.TypeOf(float64(0)),
+	tComplex:        reflect.TypeOf(complex64(0)),
+	tComplex | wide: reflect.TypeOf(complex128(0)),
+	tUintptr:        reflect.TypeOf(uintptr(0)),
+	tUintptr | raw:  reflect.TypeOf(unsafe.Pointer(nil)),
+	tInterface:      reflect.TypeOf((*any)(nil)).Elem(),
+}
+
+// decoderV1 decodes data encoded by the typeChecker-based serializer (version 1 of the encoding).
+//
+// The old serializer assigned type ids in order of type registration right after the ids of the base types,
+// so the types of the decoded values must be registered in the type registry (after RegisterBaseTypes)
+// in the same order as they were registered by the old serializer.
+// Struct fields are identified by their positions, or by their names in StructCodingModeName;
+// data encoded in the old StructCodingModeIndex mode (with explicit field indexes) is not supported.
+type decoderV1 struct {
+	*Unserializer
+	rels  map[int]int // ids of the pointed values and ids of the pointers to them
+	depth int
+}
+
+func decodeV1(u *Unserializer) reflect.Value {
+	d := &decoderV1{
+		Unserializer: u,
+		rels:         make(map[int]int),
+	}
+	return d.decodeNode(u.root)
+}
+
+// v1TypeId converts type id of version 1 to type id of the registry with registered base types:
+// the old serializer did not assign id to nil and assigned id 0 to interface{}.
+func v1TypeId(id int) int {
+	switch {
+	case id == 0:
+		return numOfKnownTypes + 1
+	case id < numOfKnownTypes:
+		return id + 1
+	default:
+		return id + 2
+	}
+}
+
+func (d *decoderV1) decodeNode(value reflect.Value) reflect.Value {
+	d.depth++
+	checkLimit("depth", d.depth, d.limits.MaxDepth)
+	checkLimit("node count", d.id+1, d.limits.MaxNodes)
+	isNil := false
+	t := d.top()
+	if t&mask == tType {
+		isNil = t&null != 0
+		if t&custom == 0 {
+			t = d.peek(int(t&0b11) + 2)
+		}
+	}
+	id := d.id
+	proceed := true
+	var v reflect.Value
+	switch t & mask {
+	case tType:
+		v = d.decodeSerializable()
+	case tNil:
+		d.decodeNil()
+	case tBool:
+		v = d.decodeBool()
+	case tInt8:
+		v = d.decodeFixedInt()
+	case tInt:
+		v = d.decodeInt()
+	case tFloat:
+		v = d.decodeFloat()
+	case tComplex:
+		v = d.decodeComplex()
+	case tString:
+		v = d.decodeString()
+	case tUintptr:
+		v = d.decodeUintptr()
+	case tChan:
+		if t&tFunc == tFunc {
+			v = d.decodeFunc(isNil)
+		} else {
+			v = d.decodeChan(isNil)
+		}
+	case tList:
+		v = d.decodeList(value, isNil)
+		proceed = false
+	case tMap:
+		v = d.decodeMap(isNil)
+		proceed = false
+	case tStruct:
+		v = d.decodeStruct(value)
+		proceed = false
+	case tPointer:
+		v = d.decodePointer(value, isNil || t&null != 0)
+		proceed = false
+	case tRef:
+		v = d.decodeReference(value)
+		proceed = false
+	case tInterface:
+		v = d.decodeInterface(isNil || t&null != 0)
+		proceed = false
+	}
+	if value.IsValid() {
+		setV1Value(value, v)
+	} else {
+		value = v
+	}
+	if proceed {
+		d.values[d.id] = value
+		d.id++
+	} else {
+		d.values[id] = value
+	}
+	d.depth--
+	return value
+}
+
+func (d *decoderV1) decodeSerializable() reflect.Value {
+	v, length, _ := d.decodeTypeWithLength(false)
+	unserializeTo(marshalerOf(v.Type()), v.Type(), v, d.readBytes(d.checkLength("length", length, d.limits.MaxLength)))
+	return v
+}
+
+func (d *decoderV1) decodeNil() {
+	d.readByte()
+}
+
+func (d *decoderV1) decodeBool() reflect.Value {
+	v := d.decodeType()
+	v.SetBool(d.data[d.pos-1]&tru != 0)
+	return v
+}
+
+func (d *decoderV1) decodeString() reflect.Value {
+	v, length, _ := d.decodeTypeWithLength(false)
+	v.SetString(string(d.readBytes(d.checkLength("length", length, d.limits.MaxLength))))
+	return v
+}
+
+func (d *decoderV1) decodeFixedInt() reflect.Value {
+	v := d.decodeType()
+	t := d.data[d.pos-1]
+	bitSize := 8 << (t & 0b11)
+	first := d.top()
+	var size int
+	if t&meta != 0 {
+		switch bitSize {
+		case 64:
+			size = int(first >> 5)
+			first &= 0b00011111
+		case 32:
+			size = int(first >> 6)
+			first &= 0b00111111
+		default:
+			size = 1
+		}
+	} else {
+		size = bitSize >> 3
+	}
+	var i uint64
+	for k, b := range d.readBytes(size) {
+		if k == 0 {
+			b = first // the first byte without meta bits
+		}
+		i = i<<8 | uint64(b)
+	}
+	if t&signed == 0 {
+		v.SetUint(i)
+	} else {
+		v.SetInt(u2i(i))
+	}
+	return v
+}
+
+func (d *decoderV1) decodeInt() reflect.Value {
+	v, i, t := d.decodeTypeWithLength(false)
+	if t&signed == 0 {
+		v.SetUint(i)
+	} else {
+		v.SetInt(u2i(i))
+	}
+	return v
+}
+
+func (d *decoderV1) decodeFloat() reflect.Value {
+	v, f, t := d.decodeTypeWithLength(false)
+	if t&wide != 0 {
+		v.SetFloat(math.Float64frombits(bits.ReverseBytes64(f)))
+	} else {
+		v.SetFloat(float64(math.Float32frombits(bits.ReverseBytes32(uint32(f)))))
+	}
+	return v
+}
+
+func (d *decoderV1) decodeComplex() reflect.Value {
+	v := d.decodeType()
+	r := d.decodeFloat()
+	i := d.decodeFloat()
+	v.SetComplex(complex(r.Float(), i.Float()))
+	return v
+}
+
+func (d *decoderV1) decodeUintptr() reflect.Value {
+	v, ptr, t := d.decodeTypeWithLength(false)
+	if t&raw != 0 {
+		v.SetPointer(unsafe.Pointer(uintptr(ptr)))
+	} else {
+		v.SetUint(ptr)
+	}
+	return v
+}
+
+func (d *decoderV1) decodeChan(isNil bool) reflect.Value {
+	v := d.decodeType()
+	if isNil {
+		return v
+	}
+	size := int(d.readByte()&0b111) + 1
+	cap := d.checkLength("channel capacity", d.readUint(size), d.limits.MaxChanCapacity)
+	t := v.Type()
+	d.checkSpareCapacity("channel capacity", t.Elem(), cap)
+	if t.ChanDir() == reflect.BothDir {
+		return reflect.MakeChan(t, cap)
+	}
+	el := t.Elem()
+	biDirChan := reflect.ChanOf(reflect.BothDir, el)
+	unDirChan := reflect.ChanOf(t.ChanDir(), el)
+	return reflect.MakeChan(biDirChan, cap).Convert(unDirChan).Convert(t)
+}
+
+func (d *decoderV1) decodeFunc(isNil bool) reflect.Value {
+	v := d.decodeType()
+	if !isNil {
+		v.Set(d.typeRegistry.funcByType(v.Type()))
+	}
+	return v
+}
+
+func (d *decoderV1) decodeList(value reflect.Value, isNil bool) reflect.Value {
+	v, l, t := d.decodeTypeWithLength(isNil)
+	length := d.checkElementCount(d.checkLength("length", l, d.limits.MaxLength))
+	if t&fixed == 0 && !isNil {
+		v = reflect.MakeSlice(v.Type(), length, length)
+	} else if v = inPlaceV1Value(value, v); length > v.Len() {
+		panic(fmt.Errorf("%w: array %s has no element #%d", ErrTypeMismatch, v.Type(), length-1))
+	}
+	d.values[d.id] = v
+	d.id++
+	for i := 0; i < length; i++ {
+		d.decodeNode(v.Index(i))
+	}
+	return v
+}
+
+func (d *decoderV1) decodeMap(isNil bool) reflect.Value {
+	m, l, _ := d.decodeTypeWithLength(isNil)
+	length := d.checkElementCount(d.checkLength("length", l, d.limits.MaxLength))
+	if !isNil {
+		m = reflect.MakeMapWithSize(m.Type(), d.sizeHint(length))
+	}
+	d.values[d.id] = m
+	d.id++
+	t := m.Type()
+	for i := 0; i < length; i++ {
+		key := reflect.New(t.Key()).Elem()
+		value := reflect.New(t.Elem()).Elem()
+		d.decodeNode(key)
+		d.decodeNode(value)
+		m.SetMapIndex(key, value)
+	}
+	return m
+}
+
+func (d *decoderV1) decodeStruct(value reflect.Value) reflect.Value {
+	v, l, _ := d.decodeTypeWithLength(false)
+	v = inPlaceV1Value(value, v)
+	d.values[d.id] = v
+	d.id++
+	length := d.checkLength("length", l, d.limits.MaxLength)
+	for i := 0; i < length; i++ {
+		var field reflect.Value
+		if d.structCodingMode == StructCodingModeName {
+			name := d.decodeString().String()
+			if name == "_" {
+				field = d.fieldAt(v, d.decodeInt().Uint())
+			} else {
+				field = v.FieldByName(name)
+			}
+		} else {
+			field = d.fieldAt(v, uint64(i))
+		}
+		if field.IsValid() {
+			field = reflex.PtrAt(field.Type(), field).Elem()
+		}
+		d.decodeNode(field)
+	}
+	return v
+}
+
+func (d *decoderV1) fieldAt(v reflect.Value, i uint64) reflect.Value {
+	if i >= uint64(v.NumField()) {
+		panic(fmt.Errorf("%w: struct %s has no field #%d", ErrTypeMismatch, v.Type(), i))
+	}
+	return v.Field(int(i))
+}
+
+func (d *decoderV1) decodePointer(value reflect.Value, isNil bool) reflect.Value {
+	v := d.decodeType()
+	id := d.id
+	d.values[id] = v
+	d.id++
+	elId := d.id
+	d.rels[elId] = id
+	if isNil {
+		// the type of the pointed value follows the nil pointer
+		if el := d.decodeType(); !v.IsValid() {
+			v = reflect.Zero(pointerToV1Value(el).Type())
+		}
+	} else if el := d.decodeNode(reflect.Value{}); v.IsValid() {
+		if el.IsValid() {
+			setV1Value(v, d.pointerTo(elId, el))
+		}
+	} else if el.IsValid() {
+		v = d.pointerTo(elId, el)
+	} else if value.IsValid() {
+		if value.Kind() == reflect.Interface && !value.IsNil() {
+			v = pointerToV1Value(reflect.Zero(value.Type().Elem()))
+		} else {
+			v = reflect.Zero(value.Type())
+		}
+	} else {
+		v = reflect.ValueOf((*any)(nil))
+	}
+	d.values[id] = v
+	return v
+}
+
+// pointerTo returns a pointer to value el of node id;
+// the references to the node that follow address the value the pointer points to
+func (d *decoderV1) pointerTo(id int, el reflect.Value) reflect.Value {
+	p := pointerToV1Value(el)
+	d.values[id] = p.Elem()
+	return p
+}
+
+func (d *decoderV1) decodeReference(value reflect.Value) reflect.Value {
+	if d.top()&val != 0 {
+		return d.decodePointedValue(value)
+	}
+	v, id := d.readReference()
+	v = pointerToV1Value(v)
+	d.values[d.id] = v
+	d.rels[id] = d.id
+	d.id++
+	return v
+}
+
+// decodePointedValue decodes reference to the value which a previously decoded pointer points to
+func (d *decoderV1) decodePointedValue(value reflect.Value) reflect.Value {
+	v, id := d.readReference()
+	if value.IsValid() {
+		setV1Value(value, v)
+		v = value
+	}
+	if ptrId, exists := d.rels[id]; exists {
+		if ptr := d.values[ptrId]; ptr.CanSet() {
+			setV1Value(ptr, pointerToV1Value(v))
+		}
+	}
+	d.values[id] = v
+	return v
+}
+
+func (d *decoderV1) readReference() (reflect.Value, int) {
+	size := int(d.readByte()&0b111) + 1
+	id := d.readUint(size)
+	v, exists := d.values[int(id)]
+	if !exists || id > math.MaxInt {
+		panic(fmt.Errorf("%w: node #%d is not found", ErrBadReference, id))
+	}
+	return v, int(id)
+}
+
+func (d *decoderV1) decodeInterface(isNil bool) reflect.Value {
+	v := d.decodeType()
+	d.values[d.id] = v
+	if isNil {
+		return v
+	}
+	return d.decodeNode(v)
+}
+
+// decodeType reads type signature and returns zero value of the type,
+// or invalid value for pointers which type is determined by the pointed value
+func (d *decoderV1) decodeType() reflect.Value {
+	signature := d.readTypeSignature()
+	if len(signature) == 1 {
+		if signature[0] == tPointer || signature[0] == tNil {
+			return reflect.Value{}
+		}
+		t, exists := v1BaseTypes[signature[0]]
+		if !exists {
+			panic(fmt.Errorf("%w: type signature %#08b", ErrUnknownTypeId, signature[0]))
+		}
+		return reflect.New(t).Elem()
+	}
+	var id int
+	for _, b := range signature[1 : len(signature)-1] {
+		id = id<<8 | int(b)
+	}
+	return reflect.New(d.typeRegistry.typeById(v1TypeId(id))).Elem()
+}
+
+func (d *decoderV1) decodeTypeWithLength(isNil bool) (reflect.Value, uint64, byte) {
+	v := d.decodeType()
+	t := d.data[d.pos-1]
+	if isNil {
+		return v, 0, t
+	}
+	return v, d.readUint(int(t&0b111) + 1), t
+}
+
+func (d *decoderV1) checkLength(name string, length uint64, limit int) int {
+	if length > math.MaxInt {
+		panic(fmt.Errorf("%w: %s is %d", ErrLimitExceeded, name, length))
+	}
+	checkLimit(name, int(length), limit)
+	return int(length)
+}
+
+func (d *decoderV1) readUint(size int) uint64 {
+	var i uint64
+	for _, b := range d.readBytes(size) {
+		i = i<<8 | uint64(b)
+	}
+	return i
+}
+
+func (d *decoderV1) readTypeSignature() []byte {
+	t := d.readByte()
+	switch t & mask {
+	case tType:
+		size := int(t&0b11) + 1
+		b := append([]byte{t & mask}, d.readBytes(size)...)
+		return append(b, d.readTypeSignature()...)
+	case tList:
+		return []byte{t & (mask | fixed)}
+	case tInt8:
+		return []byte{t & (mask | 0b11 | signed)}
+	case tInt:
+		return []byte{t & (mask | signed)}
+	case tFloat, tComplex:
+		return []byte{t & (mask | wide)}
+	case tUintptr:
+		return []byte{t & (mask | raw)}
+	case tChan:
+		if t&tFunc == tFunc {
+			return []byte{tFunc}
+		}
+		return []byte{t & (mask | 0b11)}
+	default:
+		return []byte{t & mask}
+	}
+}
+
+func (d *decoderV1) peek(offset int) byte {
+	if !d.fill(offset + 1) {
+		panic(ErrUnexpectedEOF)
+	}
+	return d.data[d.pos+offset]
+}
+
+func pointerToV1Value(v reflect.Value) reflect.Value {
+	if !v.IsValid() {
+		return reflect.ValueOf((*any)(nil))
+	}
+	if v.CanAddr() {
+		return reflex.PtrAt(v.Type(), v)
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p
+}
+
+// inPlaceV1Value returns dst if it has the type of v, so that arrays and structs are decoded in place
+// and the pointers to them and their elements decoded before their end point to dst
+func inPlaceV1Value(dst, v reflect.Value) reflect.Value {
+	if dst.IsValid() && dst.CanSet() && dst.Type() == v.Type() {
+		return dst
+	}
+	return v
+}
+
+// setV1Value sets dst to src converting src to the type of dst if it is necessary
+func setV1Value(dst, src reflect.Value) {
+	if !src.IsValid() {
+		return
+	}
+	if !src.Type().AssignableTo(dst.Type()) {
+		if !src.CanConvert(dst.Type()) {
+			panic(typeMismatchError(dst.Type(), src.Type()))
+		}
+		src = src.Convert(dst.Type())
+	}
+	dst.Set(src)
+}
+
+// Migrate converts data encoded by any supported version of the serializer to the current encoding.
+// The options are applied to both decoding and encoding: limits take effect only in decoding,
+// the type id mode only in encoding.
+func Migrate(old []byte, options ...any) ([]byte, error) {
+	value, err := Unserialize(old, options...)
+	if err != nil {
+		return nil, err
+	}
+	return TrySerialize(value, options...)
+}